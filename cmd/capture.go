@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+	"net/http"
+
+	"hlsrecorder/request"
+)
+
+var maxBodySize int64
+
+// maxDrainSize is how many bytes beyond maxBodySize are read to count the size
+// of a truncated body the client did not read completely.
+const maxDrainSize = 16 << 20
+
+// capture streams a response body into the file directory. Bytes beyond
+// maxBodySize are dropped and the capture is marked as truncated.
+type capture struct {
+	Dir string
+	Id string
+	File *os.File
+	Size int64
+	Stored int64
+	Truncated bool
+	// DecodeErr is why the body could not be decoded.
+	DecodeErr error
+}
+
+func newCapture(dir, id string) (*capture, error) {
+	file, err := os.Create(dir + "/" + id + ".part")
+	if err != nil {
+		return nil, err
+	}
+	return &capture {
+		Dir: dir,
+		Id: id,
+		File: file,
+	}, nil
+}
+
+func (c *capture) Write(p []byte) (int, error) {
+	n := len(p)
+	c.Size += int64(n)
+	if maxBodySize > 0 && c.Stored + int64(len(p)) > maxBodySize {
+		p = p[:maxBodySize - c.Stored]
+		c.Truncated = true
+	}
+	if len(p) > 0 {
+		written, err := c.File.Write(p)
+		c.Stored += int64(written)
+		if err != nil {
+			return written, err
+		}
+	}
+	return n, nil
+}
+
+// finish moves the captured body to its final name, decoding it if it was sent
+// with a content encoding. A body that can't be decoded is kept as it was sent
+// and DecodeErr is set.
+func (c *capture) finish(contentEncoding string) error {
+	partName := c.File.Name()
+	filename := c.Dir + "/" + c.Id
+	if contentEncoding != "" {
+		c.DecodeErr = c.decode(contentEncoding, filename)
+		if c.DecodeErr == nil {
+			c.File.Close()
+			return os.Remove(partName)
+		}
+		os.Remove(filename)
+	}
+	err := c.File.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(partName, filename)
+}
+
+// decode writes the decoded body to filename.
+func (c *capture) decode(contentEncoding, filename string) error {
+	_, err := c.File.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	decoder, err := decodeContent(contentEncoding, c.File)
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, decoder)
+	closeErr := out.Close()
+	if err != nil && c.Truncated {
+		// A truncated body can't be decoded completely. Keep what was
+		// decoded so far.
+		err = nil
+	}
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// abort discards the captured body.
+func (c *capture) abort() {
+	c.File.Close()
+	os.Remove(c.File.Name())
+}
+
+// fill sets the size related metadata of a finished capture.
+func (c *capture) fill(metadata *request.Metadata) {
+	metadata.Time = time.Now().UnixMicro()
+	metadata.Size = c.Size
+	metadata.Truncated = c.Truncated
+	metadata.Encoded = c.DecodeErr != nil
+}
+
+// teeBody forwards a response body to the client while capturing it. The
+// capture is finished once the body is closed, reading whatever the client
+// did not consume.
+type teeBody struct {
+	Body io.ReadCloser
+	Capture *capture
+	Once sync.Once
+	Done func(c *capture, err error)
+	Err error
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.Body.Read(p)
+	if n > 0 {
+		_, werr := t.Capture.Write(p[:n])
+		if werr != nil && t.Err == nil {
+			t.Err = werr
+		}
+	}
+	if err != nil && err != io.EOF && t.Err == nil {
+		t.Err = err
+	}
+	return n, err
+}
+
+func (t *teeBody) Close() error {
+	t.Once.Do(func() {
+		if t.Err == nil {
+			body := io.Reader(t.Body)
+			if maxBodySize > 0 {
+				// Bytes beyond the size limit are only counted, up to
+				// maxDrainSize of them.
+				body = io.LimitReader(body, maxBodySize - t.Capture.Stored + maxDrainSize)
+			}
+			_, err := io.Copy(t.Capture, body)
+			if err != nil {
+				t.Err = err
+			}
+		}
+		t.Body.Close()
+		t.Done(t.Capture, t.Err)
+	})
+	return nil
+}
+
+// newTeeResponse replaces the body of res so that it is captured while it is
+// sent to the client. done is called when the response has been completed.
+func newTeeResponse(res *http.Response, dir, id string, done func(c *capture, err error)) error {
+	c, err := newCapture(dir, id)
+	if err != nil {
+		return err
+	}
+	res.Body = &teeBody {
+		Body: res.Body,
+		Capture: c,
+		Done: done,
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+	"io/ioutil"
+)
+
+func TestTeeBodyClose(t *testing.T) {
+	defer func() {
+		maxBodySize = 0
+	}()
+	tests := []struct {
+		name string
+		maxBodySize int64
+		bodySize int
+		// read is how much the client reads before closing the body.
+		read int
+		size int64
+		stored int64
+		truncated bool
+	} {
+		{"complete", 0, 100, 100, 100, 100, false},
+		{"client stopped", 0, 100, 5, 100, 100, false},
+		{"truncated", 10, 100, 100, 100, 10, true},
+		{"truncated and client stopped", 10, 100, 5, 100, 10, true},
+		{"remainder too large", 10, 10 + maxDrainSize + 100, 5, 10 + maxDrainSize, 10, true},
+	}
+	for _, test := range tests {
+		maxBodySize = test.maxBodySize
+		c, err := newCapture(t.TempDir(), "body")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var done *capture
+		body := &teeBody {
+			Body: ioutil.NopCloser(bytes.NewReader(make([]byte, test.bodySize))),
+			Capture: c,
+			Done: func(c *capture, err error) {
+				if err != nil {
+					t.Errorf("%s: %s", test.name, err)
+				}
+				done = c
+			},
+		}
+		body.Read(make([]byte, test.read))
+		body.Close()
+		c.abort()
+		if done == nil {
+			t.Errorf("%s: capture not finished", test.name)
+			continue
+		}
+		if done.Size != test.size || done.Stored != test.stored || done.Truncated != test.truncated {
+			t.Errorf("%s: got size %d, stored %d, truncated %t, want %d, %d, %t", test.name,
+				done.Size, done.Stored, done.Truncated, test.size, test.stored, test.truncated)
+		}
+	}
+}
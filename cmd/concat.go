@@ -0,0 +1,264 @@
+package cmd
+
+import (
+	"os"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+	"encoding/json"
+
+
+	"hlsrecorder/request"
+)
+
+// concatEntry describes where a segment ended up in a concatenated file.
+type concatEntry struct {
+	SeqId uint64 `json:"seq"`
+	DiscontinuitySeq uint64 `json:"discontinuity_seq"`
+	URI string `json:"uri"`
+	Offset int64 `json:"offset"`
+	Size int64 `json:"size"`
+	Duration float64 `json:"duration"`
+	ProgramDateTime *time.Time `json:"program_date_time,omitempty"`
+}
+
+// concatSidecar is written next to every concatenated file.
+type concatSidecar struct {
+	Rendition string `json:"rendition"`
+	File string `json:"file"`
+	Init string `json:"init,omitempty"`
+	InitSize int64 `json:"init_size,omitempty"`
+	Segments []concatEntry `json:"segments"`
+}
+
+type concatOutput struct {
+	File *os.File
+	Offset int64
+	Sidecar concatSidecar
+	SidecarName string
+}
+
+func (o *concatOutput) close() error {
+	err := o.File.Close()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(o.Sidecar, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(o.SidecarName, data, 0644)
+}
+
+// readInit reads the media initialization section of a segment. An init
+// section encrypted with AES-128 is decrypted with the key of the segment.
+func readInit(playlist *request.Playlist, segment request.Segment) ([]byte, error) {
+	segmentMap := segment.Map
+	data := playlist.ReadFile(segmentMap.URI)
+	if data == nil {
+		return nil, fmt.Errorf("init section %s was not captured", segmentMap.URI)
+	}
+	if segmentMap.Limit > 0 {
+		if segmentMap.Offset + segmentMap.Limit > int64(len(data)) {
+			return nil, fmt.Errorf("byte range of %s exceeds its size", segmentMap.URI)
+		}
+		data = data[segmentMap.Offset:segmentMap.Offset + segmentMap.Limit]
+	}
+	if segment.Key == nil || segment.Key.Method != "AES-128" || isInitBox(data) {
+		return data, nil
+	}
+	key := segmentKeyData(playlist, segment.Key)
+	if key == nil {
+		return nil, fmt.Errorf("init section %s is encrypted, but key %s was not captured",
+			segmentMap.URI, playlist.AbsoluteURI(segment.Key.URI))
+	}
+	data, err := decryptAES128CBC(data, key, segmentIV(segment.Key, segment.SeqId))
+	if err != nil || !isInitBox(data) {
+		return nil, fmt.Errorf("failed to decrypt init section %s", segmentMap.URI)
+	}
+	return data, nil
+}
+
+// isInitBox tells whether data starts with a box an init section starts with.
+func isInitBox(data []byte) bool {
+	if len(data) < 8 {
+		return false
+	}
+	switch string(data[4:8]) {
+	case "ftyp", "styp", "moov", "free", "skip":
+		return true
+	}
+	return false
+}
+
+// reopenConcatOutput continues a concatenated file written by an earlier
+// run.
+func reopenConcatOutput(outputDir, filename string) (*concatOutput, error) {
+	name := strings.TrimSuffix(filename, path.Ext(filename))
+	output := &concatOutput {
+		SidecarName: outputDir + "/" + name + ".json",
+	}
+	data, err := os.ReadFile(output.SidecarName)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &output.Sidecar)
+	if err != nil {
+		return nil, err
+	}
+	output.File, err = os.OpenFile(outputDir + "/" + filename, os.O_WRONLY | os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := output.File.Stat()
+	if err != nil {
+		output.File.Close()
+		return nil, err
+	}
+	output.Offset = info.Size()
+	return output, nil
+}
+
+// concatRendition writes the segments of a rendition into one file per
+// discontinuity, in media sequence order. With a state, only segments not
+// written by an earlier run are written, and the last file is continued if
+// they follow it.
+func concatRendition(r *rendition, outputDir string, state *concatState) error {
+	if state == nil {
+		state = &concatState{}
+	}
+	if state.Written == nil {
+		state.Written = make(map[string]bool)
+	}
+	var segments []*renditionSegment
+	for _, rs := range r.sortedSegments() {
+		key := segmentKey{rs.Segment.DiscontinuitySeq, rs.Segment.SeqId}
+		if !state.Written[key.String()] {
+			segments = append(segments, rs)
+		}
+	}
+	// The last file of the earlier run is continued by the first segment
+	// after it. Segments captured late go to files of their own before that.
+	resume := *state
+	state.Open = ""
+	var output *concatOutput
+	err := readSegments(segments, readSegment, func(rs *renditionSegment, data []byte, err error) error {
+		segment := rs.Segment
+		mapURI := ""
+		if segment.Map != nil {
+			mapURI = segment.Map.URI
+		}
+		key := segmentKey{segment.DiscontinuitySeq, segment.SeqId}
+		if resume.Open != "" && resume.Last != nil && key.after(*resume.Last) {
+			if output != nil {
+				err := output.close()
+				if err != nil {
+					return err
+				}
+				output = nil
+			}
+			if segment.DiscontinuitySeq == resume.DiscontinuitySeq && mapURI == resume.Init {
+				var err error
+				output, err = reopenConcatOutput(outputDir, resume.Open)
+				if err != nil {
+					return err
+				}
+				state.DiscontinuitySeq = resume.DiscontinuitySeq
+			}
+			resume.Open = ""
+		}
+		if output != nil && (segment.DiscontinuitySeq != state.DiscontinuitySeq ||
+				mapURI != output.Sidecar.Init) {
+			err := output.close()
+			if err != nil {
+				return err
+			}
+			output = nil
+		}
+		if err != nil {
+			if !quarantine(outputDir, quarantineName(r, segment), rs, err) {
+				fmt.Printf("Failed to decrypt %s: %s\n", segment.URI, err)
+			}
+			return nil
+		}
+		if output == nil {
+			ext := ".ts"
+			if segment.Map != nil {
+				ext = ".mp4"
+			}
+			name := fmt.Sprintf("%s_%03d", r.Name, state.Part)
+			state.Part++
+			file, err := os.Create(outputDir + "/" + name + ext)
+			if err != nil {
+				return err
+			}
+			output = &concatOutput {
+				File: file,
+				SidecarName: outputDir + "/" + name + ".json",
+				Sidecar: concatSidecar {
+					Rendition: r.URI,
+					File: name + ext,
+				},
+			}
+			if segment.Map != nil {
+				init, err := readInit(rs.Playlist, segment)
+				if err != nil {
+					output.File.Close()
+					return err
+				}
+				_, err = output.File.Write(init)
+				if err != nil {
+					output.File.Close()
+					return err
+				}
+				output.Offset = int64(len(init))
+				output.Sidecar.Init = mapURI
+				output.Sidecar.InitSize = int64(len(init))
+			}
+		}
+		_, err = output.File.Write(data)
+		if err != nil {
+			output.File.Close()
+			return err
+		}
+		entry := concatEntry {
+			SeqId: segment.SeqId,
+			DiscontinuitySeq: segment.DiscontinuitySeq,
+			URI: segment.URI,
+			Offset: output.Offset,
+			Size: int64(len(data)),
+			Duration: segment.Duration,
+		}
+		if !segment.ProgramDateTime.IsZero() {
+			programDateTime := segment.ProgramDateTime
+			entry.ProgramDateTime = &programDateTime
+		}
+		output.Sidecar.Segments = append(output.Sidecar.Segments, entry)
+		output.Offset += int64(len(data))
+		state.DiscontinuitySeq = segment.DiscontinuitySeq
+		state.Last = &key
+		state.Written[key.String()] = true
+		return nil
+	})
+	if err != nil {
+		if output != nil {
+			output.close()
+		}
+		return err
+	}
+	if output != nil {
+		state.Open = output.Sidecar.File
+		state.Init = output.Sidecar.Init
+		return output.close()
+	}
+	if resume.Open != "" {
+		// Only late segments were written, the last file can still be
+		// continued.
+		state.Open = resume.Open
+		state.DiscontinuitySeq = resume.DiscontinuitySeq
+		state.Init = resume.Init
+		state.Last = resume.Last
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package cmd
+
+import (
+	"sync"
+	"time"
+	"strconv"
+	"strings"
+	"net/http"
+	"encoding/json"
+
+	"hlsrecorder/request"
+)
+
+// playClock is the position of play in the recording. It moves forward with
+// the wall clock times Speed unless it is paused.
+type playClock struct {
+	Mutex sync.Mutex
+	// Position is the recording timestamp at Since, in microseconds.
+	Position int64
+	Since time.Time
+	Speed float64
+	Paused bool
+	// Origin is the timestamp of the first request, which offsets are
+	// relative to.
+	Origin int64
+	// Seeks counts the seeks, so that updatePlaylist can go back in time.
+	Seeks int
+}
+
+// playback is nil with --realtime, which always plays the latest playlist.
+var playback *playClock
+
+// controlToken is required by the actions of the control API, so that web
+// pages open in a browser can not control playback.
+var controlToken string
+
+const (
+	minSpeed = 0.5
+	maxSpeed = 16
+)
+
+// newPlayClock returns a clock starting offset seconds after the first
+// request of the recording, or nil if it has no requests.
+func newPlayClock(offset int) *playClock {
+	origin, ok := recording.origin()
+	if !ok {
+		return nil
+	}
+	return &playClock {
+		Position: origin + int64(offset) * 1000000,
+		Since: time.Now(),
+		Speed: 1,
+		Origin: origin,
+	}
+}
+
+func (c *playClock) now() int64 {
+	if c.Paused {
+		return c.Position
+	}
+	return c.Position + int64(float64(time.Since(c.Since).Microseconds()) * c.Speed)
+}
+
+// timestamp returns the current position and the number of seeks so far.
+func (c *playClock) timestamp() (int64, int) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	return c.now(), c.Seeks
+}
+
+// rebase moves Position to now, so that the clock can be changed.
+func (c *playClock) rebase() {
+	c.Position = c.now()
+	c.Since = time.Now()
+}
+
+func (c *playClock) pause() {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	c.rebase()
+	c.Paused = true
+}
+
+func (c *playClock) resume() {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	c.rebase()
+	c.Paused = false
+}
+
+func (c *playClock) seek(timestamp int64) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	if timestamp < c.Origin {
+		timestamp = c.Origin
+	}
+	c.Position = timestamp
+	c.Since = time.Now()
+	c.Seeks++
+}
+
+func (c *playClock) setSpeed(speed float64) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	c.rebase()
+	c.Speed = speed
+}
+
+// interval scales a polling interval by the speed, so that faster playback
+// does not skip playlist snapshots.
+func (c *playClock) interval(d time.Duration) time.Duration {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	d = time.Duration(float64(d) / c.Speed)
+	if d < 50 * time.Millisecond {
+		d = 50 * time.Millisecond
+	}
+	return d
+}
+
+type playStatus struct {
+	Realtime bool `json:"realtime"`
+	Paused bool `json:"paused"`
+	Speed float64 `json:"speed"`
+	// Offset is the position in seconds since the first request.
+	Offset float64 `json:"offset"`
+	Time string `json:"time"`
+	MediaSequence uint64 `json:"media_sequence"`
+	DiscontinuitySequence uint64 `json:"discontinuity_sequence"`
+	Segments int `json:"segments"`
+	// PlaylistTime is when the playlist being served was captured.
+	PlaylistTime string `json:"playlist_time,omitempty"`
+}
+
+func formatTimestamp(timestamp int64) string {
+	return time.UnixMicro(timestamp).UTC().Format(time.RFC3339Nano)
+}
+
+// status reports the position of clock, which is nil with --realtime, and
+// the playlist being served.
+func (c *playClock) status(playlist *request.Playlist) playStatus {
+	status := playStatus {
+		Realtime: c == nil,
+		Speed: 1,
+	}
+	if c != nil {
+		c.Mutex.Lock()
+		status.Paused = c.Paused
+		status.Speed = c.Speed
+		position := c.now()
+		status.Offset = float64(position - c.Origin) / 1000000
+		status.Time = formatTimestamp(position)
+		c.Mutex.Unlock()
+	}
+	if playlist != nil {
+		status.MediaSequence = playlist.M3U8SeqNo
+		status.DiscontinuitySequence = playlist.M3U8Playlist.DiscontinuitySeq
+		status.Segments = len(playlist.Segments())
+		status.PlaylistTime = formatTimestamp(playlist.Time())
+		if c == nil {
+			status.Time = status.PlaylistTime
+		}
+	}
+	return status
+}
+
+// controlHandler serves the playback control API: GET /_control reports the
+// status, POST /_control/pause, /_control/resume, /_control/seek?to= with an
+// RFC3339 time or an offset from the start, and /_control/speed?factor=
+// change it and report the new status. They require controlToken as ?token=
+// or bearer token.
+func controlHandler(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/_control"), "/")
+	serveControl(w, r, action, playback, sharedSource{})
+}
+
+// serveControl serves an action of the control API for clock.
+func serveControl(w http.ResponseWriter, r *http.Request, action string, clock *playClock,
+		source playlistSource) {
+	switch action {
+	case "", "status":
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	case "pause", "resume", "seek", "speed":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", 405)
+			return
+		}
+		if !checkToken(r, controlToken) {
+			http.Error(w, "forbidden", 403)
+			return
+		}
+		if clock == nil {
+			http.Error(w, "playback can not be controlled with --realtime", 400)
+			return
+		}
+	default:
+		http.Error(w, "not found", 404)
+		return
+	}
+	switch action {
+	case "pause":
+		clock.pause()
+	case "resume":
+		clock.resume()
+	case "seek":
+		to := r.FormValue("to")
+		if to == "" {
+			http.Error(w, "to is required", 400)
+			return
+		}
+		t, err := parseTimeArg(to, time.UnixMicro(clock.Origin))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		clock.seek(t.UnixMicro())
+	case "speed":
+		speed, err := strconv.ParseFloat(r.FormValue("factor"), 64)
+		if err != nil || speed < minSpeed || speed > maxSpeed {
+			http.Error(w, "factor must be between 0.5 and 16", 400)
+			return
+		}
+		clock.setSpeed(speed)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clock.status(source.current()))
+}
@@ -2,15 +2,26 @@ package cmd
 
 import (
 	"fmt"
+	"bufio"
+	"bytes"
 	"log"
 	"os"
-	"io/ioutil"
+	"path"
+	"time"
+	"strings"
+	"runtime"
+	"syscall"
+	"os/signal"
 	"encoding/hex"
+	"encoding/json"
 	"crypto/aes"
     "crypto/cipher"
+	"encoding/binary"
 
 	"github.com/spf13/cobra"
+	"github.com/grafov/m3u8"
 
+	"hlsrecorder/mpegts"
 	"hlsrecorder/request"
 )
 
@@ -44,7 +55,7 @@ func decryptAES128CBC(encryptedData, key, iv []byte) ([]byte, error) {
     }
 
     if len(encryptedData) < aes.BlockSize || len(encryptedData)%aes.BlockSize != 0 {
-        return nil, err
+        return nil, fmt.Errorf("encrypted data length %d is not a multiple of the block size", len(encryptedData))
     }
 
     mode := cipher.NewCBCDecrypter(block, iv)
@@ -60,85 +71,328 @@ func decryptAES128CBC(encryptedData, key, iv []byte) ([]byte, error) {
     return decryptedData, nil
 }
 
-func decryptFile(key, iv []byte, data []byte, ofile string) error {
-	decrypted, err := decryptAES128CBC(data, key, iv)
+// segmentIV returns the IV of a segment. Without an IV attribute the media
+// sequence number is used as IV.
+func segmentIV(key *m3u8.Key, seqId uint64) []byte {
+	if key.IV != "" {
+		return loadIV(key.IV)
+	}
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], seqId)
+	return iv
+}
+
+// readRawSegment reads the body of a segment as it was captured.
+func readRawSegment(playlist *request.Playlist, segment request.Segment) ([]byte, error) {
+	data := playlist.ReadFile(segment.URI)
+	if data == nil {
+		return nil, fmt.Errorf("segment %s was not captured", segment.URI)
+	}
+	if segment.Limit > 0 {
+		if segment.Offset + segment.Limit > int64(len(data)) {
+			return nil, fmt.Errorf("byte range of %s exceeds its size", segment.URI)
+		}
+		data = data[segment.Offset:segment.Offset + segment.Limit]
+	}
+	return data, nil
+}
+
+// readSegment reads the body of a segment, decrypts and validates it. It
+// fails if the key is neither recorded nor given on the command line, and
+// with a badSegmentError if the segment does not decrypt to valid media.
+func readSegment(playlist *request.Playlist, segment request.Segment) ([]byte, error) {
+	data, err := readRawSegment(playlist, segment)
+	if err != nil {
+		return nil, err
+	}
+	if segment.Key == nil {
+		return data, nil
+	}
+	if segment.Key.Method != "AES-128" && segment.Key.Method != "SAMPLE-AES" {
+		return nil, fmt.Errorf("unsupported encryption method %s", segment.Key.Method)
+	}
+	if segment.Key.Method == "SAMPLE-AES" && segment.Map != nil {
+		return nil, fmt.Errorf("SAMPLE-AES is only supported for MPEG-TS and packed audio")
+	}
+	key := segmentKeyData(playlist, segment.Key)
+	if key == nil {
+		return nil, missingKeyError(playlist, segment.Key)
+	}
+	iv := segmentIV(segment.Key, segment.SeqId)
+	if iv == nil {
+		return nil, fmt.Errorf("invalid IV %s", segment.Key.IV)
+	}
+	if segment.Key.Method == "SAMPLE-AES" {
+		// Only the samples are encrypted, the container stays clear.
+		if _, err := mpegts.Sync(data); err == nil {
+			data, err = mpegts.DecryptSampleAES(data, key, iv)
+		} else {
+			data, err = mpegts.DecryptSampleAESAudio(data, key, iv)
+		}
+	} else {
+		data, err = decryptAES128CBC(data, key, iv)
+	}
 	if err != nil {
-		return err
+		return nil, &badSegmentError{err}
 	}
-	err = ioutil.WriteFile(ofile, decrypted, 0644)
+	err = validateSegment(bufio.NewReader(bytes.NewReader(data)), segment)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return data, nil
 }
 
 func dump(cmd *cobra.Command, args []string) {
 	fileDir, _ = cmd.Flags().GetString("filedir")
 	metadata, _ := cmd.Flags().GetString("metadata")
 	outputDir, _ := cmd.Flags().GetString("outputdir")
+	client, _ := cmd.Flags().GetString("client")
+	concat, _ := cmd.Flags().GetBool("concat")
+	withReport, _ := cmd.Flags().GetBool("report")
+	fromArg, _ := cmd.Flags().GetString("from")
+	toArg, _ := cmd.Flags().GetString("to")
+	format, _ := cmd.Flags().GetString("format")
+	keepEncrypted, _ := cmd.Flags().GetBool("keep-encrypted")
+	fragmented, _ := cmd.Flags().GetBool("fragmented")
+	jobs, _ = cmd.Flags().GetInt("jobs")
+	watch, _ := cmd.Flags().GetBool("watch")
+	watchInterval, _ := cmd.Flags().GetDuration("watch-interval")
+	keysDir, _ := cmd.Flags().GetString("reencrypt-keys-dir")
+	if format != "ts" && format != "hls-vod" && format != "mp4" {
+		log.Fatalf("Unknown format %s", format)
+	}
+	if watch && format != "ts" {
+		log.Fatalf("--watch only supports the ts format")
+	}
+	if concat && format != "ts" {
+		log.Fatalf("--concat only supports the ts format")
+	}
+	err := setupKeys(cmd)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = setupReencrypt(cmd)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if reencrypt != nil && (format != "hls-vod" || keepEncrypted) {
+		log.Fatalf("--reencrypt only supports the hls-vod format without --keep-encrypted")
+	}
 
 	os.Mkdir(outputDir, 0755)
 
-	database, err := request.ReadMetadata(metadata, fileDir)
+	// Segment files and concatenated files can be continued, so only those
+	// formats keep a state.
+	var state *dumpState
+	if format == "ts" {
+		stateFormat := "ts"
+		if concat {
+			stateFormat = "concat"
+		}
+		state, err = loadDumpState(outputDir, stateFormat)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	follower, err := request.FollowMetadata(metadata, client)
 	if err != nil {
 		log.Fatal(err)
 	}
-	idx := 0
-	processedFiles := make(map[string]bool)
-	for {
-		var playlist *request.Playlist
-		var err error
-		playlist, idx, err = request.LoadPlaylist(database, idx, false, -1)
-		if idx == -1 {
-			break
+	defer follower.Close()
+	database := request.NewRequestDatabase(fileDir)
+	_, err = follower.ReadNew(database)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c := newCollector(database)
+	var from, to time.Time
+	parseWindow := func() {
+		if len(database.Requests) == 0 || !from.IsZero() || !to.IsZero() {
+			return
 		}
-		idx++
-		if err != nil {
-			fmt.Printf("failed to load playlist: %s\n", err);
-			continue
-		}
-		m3u8Playlist := playlist.M3U8Playlist
-		var defaultKey []byte = nil
-		var defaultIV []byte = nil
-		if m3u8Playlist.Key != nil {
-			defaultKey = playlist.ReadFile(m3u8Playlist.Key.URI)
-			defaultIV = loadIV(m3u8Playlist.Key.IV)
-		}
-		for _, segment := range m3u8Playlist.Segments {
-			if segment == nil {
-				continue
+		base := time.UnixMicro(database.Requests[0].Time)
+		if fromArg != "" {
+			from, err = parseTimeArg(fromArg, base)
+			if err != nil {
+				log.Fatal(err)
 			}
-			filename := segment.URI
-			p, ok := processedFiles[filename]
-			if p && ok {
-				continue
+		}
+		if toArg != "" {
+			to, err = parseTimeArg(toArg, base)
+			if err != nil {
+				log.Fatal(err)
 			}
-			data := playlist.ReadFile(filename)
-			if data == nil {
-				continue
+		}
+	}
+	collect := func(retry time.Duration) {
+		c.collect(retry)
+		parseWindow()
+		if !from.IsZero() || !to.IsZero() {
+			for _, r := range c.Renditions {
+				r.filterWindow(from, to)
+			}
+		}
+	}
+	update := func(retry time.Duration) {
+		collect(retry)
+		if concat {
+			for _, r := range c.Renditions {
+				rendition := state.rendition(r.URI)
+				if rendition.Concat == nil {
+					rendition.Concat = &concatState{}
+				}
+				err = concatRendition(r, outputDir, rendition.Concat)
+				if err != nil {
+					fmt.Printf("Failed to concatenate %s: %s\n", r.URI, err)
+				}
 			}
-			var key []byte
-			var iv []byte
-			if segment.Key != nil {
-				key = playlist.ReadFile(segment.Key.URI)
-				iv = loadIV(segment.Key.IV)
-			} else {
-				key = defaultKey
-				iv = defaultIV
+		} else {
+			dumpSegments(c.Renditions, outputDir, state)
+		}
+		err = state.save(outputDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if format == "hls-vod" {
+		collect(0)
+		err = writeVOD(c.Renditions, database, outputDir, keepEncrypted)
+		if err != nil {
+			fmt.Printf("Failed to write master playlist: %s\n", err)
+		}
+		if reencrypt != nil {
+			if keysDir == "" {
+				keysDir = path.Clean(outputDir) + "-keys"
 			}
-			if key != nil && iv != nil {
-				err = decryptFile(key, iv, data, outputDir + "/" + filename)
-			} else {
-				err = ioutil.WriteFile(outputDir + "/" + filename, data, 0644)
+			used, err := reencrypt.writeKeys(keysDir)
+			if err != nil {
+				log.Fatal(err)
 			}
+			log.Printf("wrote %d keys to %s, serve them with serve-keys", used, keysDir)
+		}
+	} else if format == "mp4" {
+		collect(0)
+		for _, r := range c.Renditions {
+			err = remuxRendition(r, outputDir, fragmented)
 			if err != nil {
-				fmt.Printf("Failed to decrypt %s: %s\n", filename, err)
+				fmt.Printf("Failed to remux %s: %s\n", r.URI, err)
 			}
-			processedFiles[filename] = true
+		}
+	} else if watch {
+		watchDump(follower, c, watchInterval, update)
+	} else {
+		update(0)
+	}
+	renditions := c.Renditions
+	err = reportConflicts(renditions, outputDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if withReport {
+		reports := buildReport(renditions, 0)
+		printReport(os.Stdout, reports)
+		data, err := json.MarshalIndent(reports, "", "  ")
+		if err == nil {
+			err = os.WriteFile(outputDir + "/report.json", data, 0644)
+		}
+		if err != nil {
+			log.Fatal(err)
 		}
 	}
 }
 
+// watchRetry is how long dump --watch waits for the segments a playlist
+// snapshot references to be captured.
+const watchRetry = time.Minute
+
+// watchDump follows the metadata journal and calls update whenever requests
+// were added, until it is interrupted.
+func watchDump(follower *request.MetadataFollower, c *collector, interval time.Duration,
+				update func(retry time.Duration)) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	log.Printf("watching %s", follower.File.Name())
+	for first := true; ; first = false {
+		added := 0
+		if !first {
+			var err error
+			added, err = follower.ReadNew(c.Database)
+			if err != nil {
+				log.Printf("Warning: failed to read metadata: %s", err)
+			}
+		}
+		if first || added > 0 {
+			update(watchRetry)
+		}
+		select {
+		case <-signals:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dumpSegments writes every segment that is not in state yet to its own file,
+// named after its URI.
+func dumpSegments(renditions []*rendition, outputDir string, state *dumpState) {
+	type dumpFile struct {
+		Segment *renditionSegment
+		Filename string
+		State *renditionState
+		Key string
+	}
+	// Names are assigned up front so that they do not depend on the order
+	// the segments are written in.
+	var files []dumpFile
+	for _, r := range renditions {
+		rendition := state.rendition(r.URI)
+		for _, rs := range r.sortedSegments() {
+			segment := rs.Segment
+			key := segmentKey{segment.DiscontinuitySeq, segment.SeqId}.String()
+			if _, ok := rendition.Written[key]; ok || rendition.Quarantined[key] {
+				continue
+			}
+			filename := segment.URI
+			if state.Files[filename] {
+				ext := path.Ext(filename)
+				base := fmt.Sprintf("%s_%d_%d", strings.TrimSuffix(filename, ext),
+					segment.DiscontinuitySeq, segment.SeqId)
+				filename = base + ext
+				// Other renditions may have the same segment name.
+				for n := 2; state.Files[filename]; n++ {
+					filename = fmt.Sprintf("%s_%d%s", base, n, ext)
+				}
+			}
+			files = append(files, dumpFile{rs, filename, rendition, key})
+			state.Files[filename] = true
+			rendition.Written[key] = filename
+		}
+	}
+	pipeline(len(files), jobs, func(i int) interface{} {
+		rs := files[i].Segment
+		return copySegment(rs.Playlist, rs.Segment, outputDir + "/" + files[i].Filename)
+	}, func(i int, result interface{}) error {
+		err, ok := result.(error)
+		if !ok || err == nil {
+			return nil
+		}
+		file := files[i]
+		delete(file.State.Written, file.Key)
+		if quarantine(outputDir, file.Filename, file.Segment, err) {
+			file.State.Quarantined[file.Key] = true
+		} else {
+			// Try again on the next run, the key may be captured by then.
+			fmt.Printf("Failed to decrypt %s: %s\n", file.Filename, err)
+		}
+		return nil
+	})
+}
+
 // dumpCmd represents the dump command
 var dumpCmd = &cobra.Command{
 	Use:   "dump",
@@ -159,4 +413,18 @@ func init() {
 	// is called directly, e.g.:
 	// dumpCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 	dumpCmd.Flags().String("outputdir", "output/", "output dir")
+	dumpCmd.Flags().String("client", "", "Only dump requests of this client address or proxy user")
+	dumpCmd.Flags().String("from", "", "Only dump segments after this RFC3339 time or offset from the start of the recording, e.g. 1h20m")
+	dumpCmd.Flags().String("to", "", "Only dump segments before this RFC3339 time or offset from the start of the recording")
+	dumpCmd.Flags().Bool("report", false, "Print a gap and continuity report and write it to report.json")
+	dumpCmd.Flags().String("format", "ts", "Output format: ts (segment files), hls-vod (VOD HLS package with master playlist) or mp4 (one MP4 file per rendition)")
+	dumpCmd.Flags().Bool("keep-encrypted", false, "With hls-vod, keep segments encrypted and export their keys")
+	dumpCmd.Flags().Bool("fragmented", false, "With mp4, write a fragmented MP4 file")
+	dumpCmd.Flags().Int("jobs", runtime.NumCPU(), "Number of segments to read, decrypt and write in parallel")
+	dumpCmd.Flags().Bool("watch", false, "Follow the metadata journal of a running recording and dump new segments as they are captured")
+	dumpCmd.Flags().Duration("watch-interval", 2 * time.Second, "How often --watch checks the metadata journal")
+	dumpCmd.Flags().Bool("concat", false, "Write one file per rendition and discontinuity in media sequence order")
+	addKeyFlags(dumpCmd)
+	addReencryptFlags(dumpCmd, "http://localhost:8080")
+	dumpCmd.Flags().String("reencrypt-keys-dir", "", "Directory --reencrypt writes the keys and token to, outputdir with -keys appended if empty")
 }
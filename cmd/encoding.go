@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"io"
+	"fmt"
+	"bufio"
+	"strings"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+
+	"github.com/andybalholm/brotli"
+)
+
+// newDecodingReader wraps r with a decoder for a single content coding.
+func newDecodingReader(encoding string, r io.Reader) (io.Reader, error) {
+	switch encoding {
+	case "", "identity":
+		return r, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		// "deflate" is supposed to be zlib-wrapped, but some servers send
+		// raw deflate data.
+		buffered := bufio.NewReader(r)
+		header, _ := buffered.Peek(2)
+		if len(header) == 2 && header[0] & 0x0f == 8 &&
+				(uint16(header[0]) << 8 | uint16(header[1])) % 31 == 0 {
+			return zlib.NewReader(buffered)
+		}
+		return flate.NewReader(buffered), nil
+	case "br":
+		return brotli.NewReader(r), nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding %s", encoding)
+}
+
+// decodeContent undoes the codings listed in a Content-Encoding header. They
+// are listed in the order they were applied, so they are undone in reverse.
+func decodeContent(contentEncoding string, r io.Reader) (io.Reader, error) {
+	encodings := strings.Split(contentEncoding, ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		encoding := strings.ToLower(strings.TrimSpace(encodings[i]))
+		var err error
+		r, err = newDecodingReader(encoding, r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"os"
+	"fmt"
+	"log"
+	"strings"
+	"net/url"
+	"net/http"
+	"os/exec"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// streamHandoff is everything proxy needs to keep recording a stream that
+// was found through record.
+type streamHandoff struct {
+	URI string `json:"uri"`
+	Headers http.Header `json:"headers"`
+	Client string `json:"client,omitempty"`
+	Time int64 `json:"time"`
+}
+
+// Headers that are specific to a single request or to the connection to the
+// proxy are not handed off.
+var skippedHandoffHeaders = []string {
+	"Accept-Encoding",
+	"Connection",
+	"Content-Length",
+	"If-Modified-Since",
+	"If-None-Match",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Range",
+}
+
+// Headers that are only sent to the host of the handed off playlist.
+var credentialHeaders = []string {
+	"Authorization",
+	"Cookie",
+}
+
+func newStreamHandoff(uri string, header http.Header, client string, timestamp int64) *streamHandoff {
+	headers := header.Clone()
+	for _, name := range skippedHandoffHeaders {
+		headers.Del(name)
+	}
+	return &streamHandoff {
+		URI: uri,
+		Headers: headers,
+		Client: client,
+		Time: timestamp,
+	}
+}
+
+// redacted returns a copy of the handoff without the values of credential
+// headers, for showing it.
+func (h *streamHandoff) redacted() *streamHandoff {
+	redacted := *h
+	redacted.Headers = h.Headers.Clone()
+	for name := range redacted.Headers {
+		for _, credential := range credentialHeaders {
+			if strings.EqualFold(name, credential) {
+				redacted.Headers[name] = []string {"REDACTED"}
+			}
+		}
+	}
+	return &redacted
+}
+
+func readStreamHandoff(filename string) (*streamHandoff, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var handoff streamHandoff
+	err = json.Unmarshal(data, &handoff)
+	if err != nil {
+		return nil, err
+	}
+	if handoff.URI == "" {
+		return nil, fmt.Errorf("%s has no playlist URI", filename)
+	}
+	return &handoff, nil
+}
+
+func (h *streamHandoff) name() string {
+	sum := sha1.Sum([]byte(h.URI))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (h *streamHandoff) write(filename string) error {
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0600)
+}
+
+// apply sets the handed off headers on a request. Credentials are only sent to
+// the host the playlist was requested from.
+func (h *streamHandoff) apply(req *http.Request) {
+	sameHost := false
+	if parsedURI, err := url.Parse(h.URI); err == nil {
+		sameHost = parsedURI.Host == req.URL.Host
+	}
+	for name, values := range h.Headers {
+		isCredential := false
+		for _, credential := range credentialHeaders {
+			if strings.EqualFold(name, credential) {
+				isCredential = true
+			}
+		}
+		if isCredential && !sameHost {
+			continue
+		}
+		req.Header[name] = values
+	}
+}
+
+var handoffDir string
+
+// saveHandoff writes the handoff file of a detected playlist and returns its
+// file name.
+func saveHandoff(handoff *streamHandoff) (string, error) {
+	filename := handoffDir + "/" + handoff.name() + ".json"
+	err := handoff.write(filename)
+	if err != nil {
+		return "", err
+	}
+	return filename, nil
+}
+
+// startProxyJob runs proxy for a handed off stream as a child process, which
+// records into its own directory next to the handoff file.
+func startProxyJob(handoff *streamHandoff, listen string) (string, error) {
+	filename, err := saveHandoff(handoff)
+	if err != nil {
+		return "", err
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	dir := handoffDir + "/" + handoff.name()
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	logFile, err := os.OpenFile(dir + "/proxy.log", os.O_APPEND | os.O_WRONLY | os.O_CREATE, 0644)
+	if err != nil {
+		return "", err
+	}
+	args := []string {"proxy",
+		"--handoff", filename,
+		"--listen", listen,
+		"--filedir", dir + "/files",
+		"--metadata", dir + "/metadata.json",
+	}
+	job := exec.Command(executable, args...)
+	if upstream != nil {
+		// The URL may contain credentials, which must not show up in
+		// the process list.
+		job.Env = append(os.Environ(), upstreamProxyEnv + "=" + upstream.URL.String())
+		if len(upstream.Bypass) > 0 {
+			job.Args = append(job.Args, "--upstream-bypass", strings.Join(upstream.Bypass, ","))
+		}
+	}
+	job.Stdout = logFile
+	job.Stderr = logFile
+	err = job.Start()
+	logFile.Close()
+	if err != nil {
+		return "", err
+	}
+	log.Printf("started proxy job %d for %s on %s", job.Process.Pid, handoff.URI, listen)
+	go job.Wait()
+	return dir, nil
+}
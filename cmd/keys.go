@@ -0,0 +1,265 @@
+package cmd
+
+import (
+	"os"
+	"fmt"
+	"log"
+	"sync"
+	"bufio"
+	"strings"
+	"net/url"
+	"path/filepath"
+	"encoding/hex"
+	"crypto/aes"
+	"crypto/sha1"
+
+	"github.com/spf13/cobra"
+	"github.com/grafov/m3u8"
+
+	"hlsrecorder/request"
+)
+
+// keyStore holds keys given on the command line. They take priority over the
+// recorded key bodies, e.g. if the client cached the key or got it from a
+// separate license flow.
+type keyStore struct {
+	Mutex sync.Mutex
+	// URIs maps absolute key URIs to keys.
+	URIs map[string][]byte
+	// Dir holds key files named after the key URI or its KEYFORMAT.
+	Dir string
+	Files map[string][]byte
+}
+
+var keyOverrides = &keyStore {
+	URIs: make(map[string][]byte),
+	Files: make(map[string][]byte),
+}
+
+// parseKey decodes a key given as 32 hex digits, optionally prefixed with 0x.
+func parseKey(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	value = strings.TrimPrefix(strings.TrimPrefix(value, "0x"), "0X")
+	key, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key %s: %s", value, err)
+	}
+	if len(key) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid key length %d", len(key))
+	}
+	return key, nil
+}
+
+// add adds a URI=hex mapping. The key never contains '=', so the URI may.
+func (s *keyStore) add(mapping string) error {
+	i := strings.LastIndex(mapping, "=")
+	if i <= 0 {
+		return fmt.Errorf("key must be URI=hex: %s", mapping)
+	}
+	key, err := parseKey(mapping[i + 1:])
+	if err != nil {
+		return err
+	}
+	s.URIs[strings.TrimSpace(mapping[:i])] = key
+	return nil
+}
+
+// loadFile adds the URI=hex mappings of a file, one per line. Empty lines and
+// lines starting with # are skipped.
+func (s *keyStore) loadFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		err = s.add(text)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", filename, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// keyFileName turns a URI or KEYFORMAT into a name usable in the keys directory.
+func keyFileName(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+				r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, value)
+}
+
+// readDirKey reads a key from the keys directory, either as 16 raw bytes or
+// as hex digits.
+func (s *keyStore) readDirKey(name string) []byte {
+	if name == "" || name == "." || name == "_" {
+		return nil
+	}
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	if key, ok := s.Files[name]; ok {
+		return key
+	}
+	data, err := os.ReadFile(filepath.Join(s.Dir, name))
+	var key []byte
+	if err == nil {
+		if len(data) == aes.BlockSize {
+			key = data
+		} else if key, err = parseKey(string(data)); err != nil {
+			fmt.Printf("Failed to read key %s: %s\n", name, err)
+		}
+	}
+	s.Files[name] = key
+	return key
+}
+
+// lookup returns the key given for an absolute key URI, or nil. Mappings are
+// tried with and without the query, which often holds a token, before the
+// keys directory is searched for the URI, its base name and the KEYFORMAT.
+func (s *keyStore) lookup(uri, keyFormat string) []byte {
+	withoutQuery := uri
+	if i := strings.Index(uri, "?"); i != -1 {
+		withoutQuery = uri[:i]
+	}
+	if key, ok := s.URIs[uri]; ok {
+		return key
+	}
+	if key, ok := s.URIs[withoutQuery]; ok {
+		return key
+	}
+	if s.Dir == "" {
+		return nil
+	}
+	if key := s.readDirKey(keyFileName(withoutQuery)); key != nil {
+		return key
+	}
+	if parsedURI, err := url.Parse(uri); err == nil && parsedURI.Path != "" {
+		if key := s.readDirKey(keyFileName(filepath.Base(parsedURI.Path))); key != nil {
+			return key
+		}
+	}
+	if keyFormat != "" {
+		return s.readDirKey(keyFileName(keyFormat))
+	}
+	return nil
+}
+
+// segmentKeyData returns the key of a segment, preferring the keys given on
+// the command line to the recorded key body. It returns nil if neither exists.
+func segmentKeyData(playlist *request.Playlist, key *m3u8.Key) []byte {
+	if key.URI == "" {
+		return nil
+	}
+	if data := keyOverrides.lookup(playlist.AbsoluteURI(key.URI), key.Keyformat); data != nil {
+		return data
+	}
+	return playlist.ReadFile(key.URI)
+}
+
+// localizeKeys gives the keys of playlist that were not captured but are given
+// on the command line local names, so that players request them from play
+// instead of the key server. They are no longer listed in Missing.
+func localizeKeys(playlist *request.Playlist) {
+	var missing []string
+	for _, uri := range playlist.Missing {
+		if _, ok := playlist.Names[uri]; ok {
+			// Key tags are listed once for every time they are used.
+			continue
+		}
+		key := findKey(playlist, uri)
+		if key == nil || keyOverrides.lookup(uri, key.Keyformat) == nil {
+			missing = append(missing, uri)
+			continue
+		}
+		sum := sha1.Sum([]byte(uri))
+		name := "key-" + hex.EncodeToString(sum[:8]) + ".key"
+		playlist.Names[uri] = name
+		if key := playlist.M3U8Playlist.Key; key != nil && key.URI == uri {
+			key.URI = name
+		}
+		for _, segment := range playlist.M3U8Playlist.Segments {
+			if segment != nil && segment.Key != nil && segment.Key.URI == uri {
+				segment.Key.URI = name
+			}
+		}
+	}
+	playlist.Missing = missing
+}
+
+// missingKeyError tells why the key of a segment is not available.
+func missingKeyError(playlist *request.Playlist, key *m3u8.Key) error {
+	if playlist.IsUnsupported(key.URI) {
+		format := key.Keyformat
+		if format == "" {
+			format = "identity"
+		}
+		return fmt.Errorf("key %s with KEYFORMAT %s is not supported, use --decrypt-key to provide it",
+			playlist.AbsoluteURI(key.URI), format)
+	}
+	return fmt.Errorf("key %s was not captured, use --decrypt-key to provide it",
+		playlist.AbsoluteURI(key.URI))
+}
+
+// undecryptable tells whether key is a key that is not supported and was not
+// given on the command line. Segments encrypted with it are passed through.
+func undecryptable(playlist *request.Playlist, key *m3u8.Key) bool {
+	return key != nil && playlist.IsUnsupported(key.URI) && segmentKeyData(playlist, key) == nil
+}
+
+var warnedKeys = struct {
+	sync.Mutex
+	URIs map[string]bool
+} {
+	URIs: make(map[string]bool),
+}
+
+// warnUnsupportedKeys warns once about every key of playlist that is not
+// supported.
+func warnUnsupportedKeys(playlist *request.Playlist) {
+	warnedKeys.Lock()
+	defer warnedKeys.Unlock()
+	for _, uri := range playlist.Unsupported {
+		if warnedKeys.URIs[uri] {
+			continue
+		}
+		warnedKeys.URIs[uri] = true
+		log.Printf("Warning: skipping unsupported key %s, use --decrypt-key to provide it", uri)
+	}
+}
+
+func addKeyFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArray("decrypt-key", nil, "Key to use for a key URI as URI=hex, can be repeated")
+	cmd.Flags().String("key-file", "", "File with a URI=hex key mapping per line")
+	cmd.Flags().String("keys-dir", "", "Directory with key files named after the key URI, its base name or its KEYFORMAT")
+}
+
+// setupKeys fills keyOverrides from the key flags.
+func setupKeys(cmd *cobra.Command) error {
+	mappings, _ := cmd.Flags().GetStringArray("decrypt-key")
+	keyFile, _ := cmd.Flags().GetString("key-file")
+	keysDir, _ := cmd.Flags().GetString("keys-dir")
+	for _, mapping := range mappings {
+		err := keyOverrides.add(mapping)
+		if err != nil {
+			return err
+		}
+	}
+	if keyFile != "" {
+		err := keyOverrides.loadFile(keyFile)
+		if err != nil {
+			return err
+		}
+	}
+	keyOverrides.Dir = keysDir
+	return nil
+}
@@ -0,0 +1,241 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+	"strings"
+	"strconv"
+	"net/url"
+	"net/http"
+
+	"hlsrecorder/request"
+)
+
+// playlistChanged is closed and replaced whenever currentPlaylist changes, so
+// that blocking playlist reloads can wait for it. It is guarded by mutex.
+var playlistChanged = make(chan struct{})
+
+func setCurrentPlaylist(playlist *request.Playlist) {
+	mutex.Lock()
+	currentPlaylist = playlist
+	close(playlistChanged)
+	playlistChanged = make(chan struct{})
+	mutex.Unlock()
+}
+
+// playlistSource is where playlists are served from, currentPlaylist or the
+// timeline of a play session.
+type playlistSource interface {
+	current() *request.Playlist
+	// wait waits until the playlist is different from playlist or the
+	// deadline passes, and returns it.
+	wait(playlist *request.Playlist, deadline time.Time) *request.Playlist
+}
+
+// sharedSource serves currentPlaylist.
+type sharedSource struct{}
+
+func (sharedSource) current() *request.Playlist {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return currentPlaylist
+}
+
+func (sharedSource) wait(playlist *request.Playlist, deadline time.Time) *request.Playlist {
+	mutex.Lock()
+	current := currentPlaylist
+	changed := playlistChanged
+	mutex.Unlock()
+	if current != playlist {
+		return current
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-changed:
+	case <-timer.C:
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	return currentPlaylist
+}
+
+// blockTimeout is how long blocking requests wait, three target durations.
+func blockTimeout(playlist *request.Playlist) time.Duration {
+	return time.Duration(3 * float64(playlist.M3U8Playlist.TargetDuration) * float64(time.Second))
+}
+
+// blockingReload holds a playlist request with _HLS_msn and _HLS_part until
+// the playlist contains the requested segment or part. It returns the
+// playlist to serve, or an HTTP status on failure.
+func blockingReload(r *http.Request, source playlistSource, playlist *request.Playlist) (*request.Playlist, int) {
+	query := r.URL.Query()
+	if !query.Has("_HLS_msn") {
+		if query.Has("_HLS_part") {
+			return nil, http.StatusBadRequest
+		}
+		return playlist, http.StatusOK
+	}
+	if !playlist.ServerControl.CanBlockReload {
+		return playlist, http.StatusOK
+	}
+	seqId, err := strconv.ParseUint(query.Get("_HLS_msn"), 10, 64)
+	if err != nil {
+		return nil, http.StatusBadRequest
+	}
+	part := -1
+	if query.Has("_HLS_part") {
+		part, err = strconv.Atoi(query.Get("_HLS_part"))
+		if err != nil || part < 0 {
+			return nil, http.StatusBadRequest
+		}
+	}
+	if next, _ := playlist.Progress(); seqId > next + 1 {
+		return nil, http.StatusBadRequest
+	}
+	deadline := time.Now().Add(blockTimeout(playlist))
+	for !playlist.Contains(seqId, part) {
+		if !time.Now().Before(deadline) {
+			return nil, http.StatusServiceUnavailable
+		}
+		playlist = source.wait(playlist, deadline)
+	}
+	return playlist, http.StatusOK
+}
+
+// Tags that apply to the whole playlist and are kept by delta updates.
+var playlistTags = []string {
+	"#EXTM3U",
+	"#EXT-X-VERSION:",
+	"#EXT-X-TARGETDURATION:",
+	"#EXT-X-MEDIA-SEQUENCE:",
+	"#EXT-X-DISCONTINUITY-SEQUENCE:",
+	"#EXT-X-PLAYLIST-TYPE:",
+	"#EXT-X-INDEPENDENT-SEGMENTS",
+	"#EXT-X-START:",
+	"#EXT-X-DEFINE:",
+	"#EXT-X-SERVER-CONTROL:",
+	"#EXT-X-PART-INF:",
+}
+
+// Tags that apply to the next media segment. The first of them ends the
+// header of a playlist.
+var segmentTags = []string {
+	"#EXTINF:",
+	"#EXT-X-BYTERANGE:",
+	"#EXT-X-DISCONTINUITY",
+	"#EXT-X-KEY:",
+	"#EXT-X-MAP:",
+	"#EXT-X-PROGRAM-DATE-TIME:",
+	"#EXT-X-DATERANGE:",
+	"#EXT-X-GAP",
+	"#EXT-X-BITRATE:",
+	"#EXT-X-PART:",
+}
+
+func hasTag(line string, tags []string) bool {
+	for _, tag := range tags {
+		if strings.HasPrefix(line, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// deltaPlaylist returns a delta update of text for _HLS_skip, with the
+// segments that may be skipped replaced by an EXT-X-SKIP tag. Date ranges are
+// always kept, also with v2, as skipping them requires listing the recently
+// removed ones, which are not known.
+func deltaPlaylist(playlist *request.Playlist, text, skip string) string {
+	if skip != "YES" && skip != "v2" {
+		return text
+	}
+	skipped := playlist.SkippableSegments()
+	if skipped == 0 {
+		return text
+	}
+	var lines []string
+	n := 0
+	header := true
+	inserted := false
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		isURI := trimmed != "" && !strings.HasPrefix(trimmed, "#")
+		if (isURI || hasTag(trimmed, segmentTags)) && !hasTag(trimmed, playlistTags) {
+			header = false
+		}
+		if n < skipped {
+			keep := header || hasTag(trimmed, playlistTags) || trimmed == "" ||
+				strings.HasPrefix(trimmed, "#EXT-X-DATERANGE:")
+			if isURI {
+				n++
+			}
+			if keep {
+				lines = append(lines, line)
+			} else if !inserted {
+				lines = append(lines, fmt.Sprintf("#EXT-X-SKIP:SKIPPED-SEGMENTS=%d", skipped))
+				inserted = true
+			}
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// preloadHint returns the preload hint of playlist for filename, or nil.
+func preloadHint(playlist *request.Playlist, filename string) *request.PreloadHint {
+	for i, hint := range playlist.PreloadHints {
+		if hint.URI == filename {
+			return &playlist.PreloadHints[i]
+		}
+	}
+	return nil
+}
+
+// waitPreload holds a request for a preload hint of playlist until a later
+// playlist lists it as a captured part. It returns the playlist the file can
+// be served from, or nil on timeout.
+func waitPreload(source playlistSource, playlist *request.Playlist, filename string) *request.Playlist {
+	deadline := time.Now().Add(blockTimeout(playlist))
+	for time.Now().Before(deadline) {
+		playlist = source.wait(playlist, deadline)
+		if _, ok := playlist.Files[filename]; ok {
+			return playlist
+		}
+		if preloadHint(playlist, filename) == nil {
+			// The hint was dropped without the part being captured.
+			return nil
+		}
+	}
+	return nil
+}
+
+// pollInterval is how often playlists are reloaded, often enough to follow
+// the parts of low-latency playlists.
+func pollInterval(playlist *request.Playlist) time.Duration {
+	if playlist != nil && playlist.PartTarget > 0 && playlist.PartTarget < 2 {
+		return time.Duration(playlist.PartTarget / 2 * float64(time.Second))
+	}
+	return time.Second
+}
+
+// blockingReloadURI returns the URI that requests the next part or segment
+// of playlist with a blocking reload, or uri if the server can not block.
+func blockingReloadURI(uri string, playlist *request.Playlist) string {
+	if playlist == nil || !playlist.ServerControl.CanBlockReload {
+		return uri
+	}
+	parsedURI, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	next, parts := playlist.Progress()
+	query := parsedURI.Query()
+	query.Set("_HLS_msn", strconv.FormatUint(next, 10))
+	if playlist.PartTarget > 0 {
+		query.Set("_HLS_part", strconv.Itoa(parts))
+	}
+	parsedURI.RawQuery = query.Encode()
+	return parsedURI.String()
+}
@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+
+	"hlsrecorder/request"
+)
+
+// jobs is the number of segments dump reads and decrypts in parallel.
+var jobs = 1
+
+// pipeline runs work for 0..n-1 on up to jobs goroutines and calls done with
+// the results in order, so the outcome does not depend on scheduling. At most
+// jobs results are pending at any time, which bounds memory use. pipeline
+// stops at the first error of done.
+func pipeline(n, jobs int, work func(i int) interface{}, done func(i int, result interface{}) error) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+	results := make([]chan interface{}, n)
+	for i := range results {
+		results[i] = make(chan interface{}, 1)
+	}
+	slots := make(chan struct{}, jobs)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for i := 0; i < n; i++ {
+			select {
+			case slots <- struct{}{}:
+			case <-stop:
+				return
+			}
+			go func(i int) {
+				results[i] <- work(i)
+			}(i)
+		}
+	}()
+	for i := 0; i < n; i++ {
+		result := <-results[i]
+		<-slots
+		err := done(i, result)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type segmentData struct {
+	Data []byte
+	Err error
+}
+
+// readSegments reads and decrypts segments in parallel and calls done with
+// them in order.
+func readSegments(segments []*renditionSegment, read func(*request.Playlist, request.Segment) ([]byte, error),
+					done func(rs *renditionSegment, data []byte, err error) error) error {
+	return pipeline(len(segments), jobs, func(i int) interface{} {
+		data, err := read(segments[i].Playlist, segments[i].Segment)
+		return segmentData{data, err}
+	}, func(i int, result interface{}) error {
+		r := result.(segmentData)
+		return done(segments[i], r.Data, r.Err)
+	})
+}
+
+// cbcReader decrypts AES-128-CBC while reading. The last block is held back
+// until the end of the input so that its padding can be removed.
+type cbcReader struct {
+	Source io.Reader
+	Mode cipher.BlockMode
+	Buffer []byte
+	Plain []byte
+	EOF bool
+	// Err is kept, so that it is not lost to a reader that buffers ahead.
+	Err error
+}
+
+func newCBCReader(source io.Reader, key, iv []byte) (*cbcReader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, &badSegmentError{err}
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, badSegment("invalid IV length %d", len(iv))
+	}
+	return &cbcReader {
+		Source: source,
+		Mode: cipher.NewCBCDecrypter(block, iv),
+		Buffer: make([]byte, 0, 64 * 1024),
+	}, nil
+}
+
+func (r *cbcReader) Read(p []byte) (int, error) {
+	if r.Err != nil {
+		return 0, r.Err
+	}
+	for len(r.Plain) == 0 {
+		if r.EOF {
+			return 0, io.EOF
+		}
+		n, err := r.Source.Read(r.Buffer[len(r.Buffer):cap(r.Buffer)])
+		r.Buffer = r.Buffer[:len(r.Buffer) + n]
+		if err == io.EOF {
+			r.EOF = true
+		} else if err != nil {
+			return 0, err
+		}
+		ready := len(r.Buffer) / aes.BlockSize * aes.BlockSize
+		if !r.EOF {
+			// Keep the last block until it is known to be the last one.
+			ready -= aes.BlockSize
+		} else if len(r.Buffer) % aes.BlockSize != 0 || len(r.Buffer) == 0 {
+			r.Err = badSegment("encrypted data is not a multiple of the block size")
+			return 0, r.Err
+		}
+		if ready <= 0 {
+			continue
+		}
+		plain := make([]byte, ready)
+		r.Mode.CryptBlocks(plain, r.Buffer[:ready])
+		r.Buffer = r.Buffer[:copy(r.Buffer, r.Buffer[ready:])]
+		if r.EOF {
+			plain, err = unpad(plain)
+			if err != nil {
+				r.Err = &badSegmentError{err}
+				return 0, r.Err
+			}
+		}
+		r.Plain = plain
+	}
+	n := copy(p, r.Plain)
+	r.Plain = r.Plain[n:]
+	return n, nil
+}
+
+type segmentReader struct {
+	io.Reader
+	File *os.File
+}
+
+func (r *segmentReader) Close() error {
+	return r.File.Close()
+}
+
+// openSegment is the streaming counterpart of readSegment.
+func openSegment(playlist *request.Playlist, segment request.Segment) (io.ReadCloser, error) {
+	file, err := playlist.OpenFile(segment.URI)
+	if err != nil {
+		return nil, fmt.Errorf("segment %s was not captured", segment.URI)
+	}
+	var reader io.Reader = file
+	if segment.Limit > 0 {
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if segment.Offset + segment.Limit > info.Size() {
+			file.Close()
+			return nil, fmt.Errorf("byte range of %s exceeds its size", segment.URI)
+		}
+		reader = io.NewSectionReader(file, segment.Offset, segment.Limit)
+	}
+	if segment.Key != nil && segment.Key.Method != "AES-128" {
+		// SAMPLE-AES needs the whole segment.
+		file.Close()
+		data, err := readSegment(playlist, segment)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	if segment.Key != nil {
+		key := segmentKeyData(playlist, segment.Key)
+		if key == nil {
+			file.Close()
+			return nil, missingKeyError(playlist, segment.Key)
+		}
+		reader, err = newCBCReader(reader, key, segmentIV(segment.Key, segment.SeqId))
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return &segmentReader{reader, file}, nil
+}
+
+// copySegment writes a segment to filename without holding it in memory.
+// Decrypted segments are validated while they are written.
+func copySegment(playlist *request.Playlist, segment request.Segment, filename string) error {
+	reader, err := openSegment(playlist, segment)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if segment.Key != nil {
+		err = validateSegment(bufio.NewReader(io.TeeReader(reader, file)), segment)
+	} else {
+		_, err = io.Copy(file, reader)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(filename)
+		return err
+	}
+	return file.Close()
+}
@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"fmt"
+	"bytes"
 	"time"
 	"sync"
 	"net/http"
@@ -8,6 +10,7 @@ import (
 	"strings"
 
 	"github.com/spf13/cobra"
+	"github.com/grafov/m3u8"
 
 	"hlsrecorder/request"
 )
@@ -15,79 +18,275 @@ import (
 var mutex sync.Mutex
 var currentPlaylist *request.Playlist
 
-func findLastPlaylist(metadata, fileDir string, timestamp int64) *request.Playlist {
+// serveClear makes fileHandler serve decrypted segments and playlists without
+// key tags, for players that do not support encryption.
+var serveClear bool
+
+// rewriteURIs makes fileHandler serve the captured playlist text with only
+// its URIs rewritten, instead of the playlist serialized by m3u8, which drops
+// the tags it does not know.
+var rewriteURIs bool
+
+var warnedLowLatency sync.Once
+
+// playlistText returns the text playlists are served from.
+func playlistText(playlist *request.Playlist) string {
+	// m3u8 drops the parts and preload hints of low-latency playlists, and
+	// M3U8File has the URIs of files that were renamed.
+	if rewriteURIs || playlist.IsLowLatency() || playlist.Renamed() {
+		return playlist.RewriteURIs()
+	}
+	return playlist.M3U8File
+}
+
+// readDatabase reads the metadata file, keeping only the requests of client
+// if it is set.
+func readDatabase(metadata, fileDir, client string) (*request.RequestDatabase, error) {
 	database, err := request.ReadMetadata(metadata, fileDir)
 	if err != nil {
+		return nil, err
+	}
+	if client != "" {
+		database = database.FilterClient(client)
+	}
+	return database, nil
+}
+
+// findKey returns the key tag of playlist whose URI is filename, or nil.
+func findKey(playlist *request.Playlist, filename string) *m3u8.Key {
+	if key := playlist.M3U8Playlist.Key; key != nil && key.URI == filename {
+		return key
+	}
+	for _, segment := range playlist.M3U8Playlist.Segments {
+		if segment != nil && segment.Key != nil && segment.Key.URI == filename {
+			return segment.Key
+		}
+	}
+	return nil
+}
+
+// keysAvailable tells whether the files of playlist that were not captured
+// are all keys given on the command line.
+func keysAvailable(playlist *request.Playlist) bool {
+	for _, uri := range playlist.Missing {
+		key := findKey(playlist, uri)
+		if key == nil || segmentKeyData(playlist, key) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// playlistKey returns the key given on the command line for a key file of
+// playlist, or nil.
+func playlistKey(playlist *request.Playlist, filename string) []byte {
+	key := findKey(playlist, filename)
+	if key == nil {
 		return nil
 	}
-	idx := -1
-	var playlist *request.Playlist
+	return keyOverrides.lookup(playlist.AbsoluteURI(filename), key.Keyformat)
+}
+
+func updatePlaylist() error {
+	seeks := 0
+	seeked := false
 	for {
-		playlist, idx, err = request.LoadPlaylist(database, idx, true, timestamp)
-		if idx == -1 {
-			break
+		var timestamp int64
+		timestamp = -1
+		if playback != nil {
+			var n int
+			timestamp, n = playback.timestamp()
+			if n != seeks {
+				// Seeking may go back, so the playlist is replaced even if
+				// it is older.
+				seeks = n
+				seeked = true
+			}
 		}
-		if err == nil {
-			return playlist
+		playlist := recording.playlistAt(timestamp)
+		mutex.Lock()
+		current := currentPlaylist
+		mutex.Unlock()
+		if playlist != nil && (current == nil || seeked || playlist.Newer(current)) {
+			setCurrentPlaylist(playlist)
+			current = playlist
+			seeked = false
 		}
-		if idx == 0 {
-			break
+		interval := pollInterval(current)
+		if playback != nil {
+			interval = playback.interval(interval)
 		}
-		idx--
+		time.Sleep(interval)
 	}
-	return nil
 }
 
-func updatePlaylist(realtime bool, offset int, metadata, fileDir string) error {
-	var timestamp int64
-	timestamp = -1
-	if !realtime {
-		database, err := request.ReadMetadata(metadata, fileDir)
-		if err == nil && len(database.Requests) > 0 {
-			timestamp = database.Requests[0].Time + int64(offset) * 1000000
+// keptKeyTag tells whether a key tag of playlist is for a key that can not be
+// decrypted, so that it is kept when serving.
+func keptKeyTag(playlist *request.Playlist, line string) bool {
+	for _, uri := range playlist.Unsupported {
+		if strings.Contains(line, "URI=\"" + uri + "\"") {
+			return undecryptable(playlist, findKey(playlist, uri))
 		}
 	}
-	base := timestamp
-	start := time.Now().UnixMicro()
-	for {
-		playlist := findLastPlaylist(metadata, fileDir, timestamp)
-		if playlist != nil {
-			mutex.Lock()
-			if currentPlaylist == nil || currentPlaylist.M3U8SeqNo < playlist.M3U8SeqNo {
-				currentPlaylist = playlist
+	return false
+}
+
+// removeKeyTags removes the EXT-X-KEY tags of a playlist, except for those of
+// keys that can not be decrypted.
+func removeKeyTags(playlist *request.Playlist) string {
+	var lines []string
+	kept := false
+	for _, line := range strings.Split(playlistText(playlist), "\n") {
+		if strings.HasPrefix(line, "#EXT-X-KEY:") {
+			if keptKeyTag(playlist, line) {
+				kept = true
+			} else if kept {
+				line = "#EXT-X-KEY:METHOD=NONE"
+				kept = false
+			} else {
+				continue
 			}
-			mutex.Unlock()
 		}
-		time.Sleep(time.Second)
-		diff := time.Now().UnixMicro() - start
-		if !realtime {
-			timestamp = base + diff
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// reencryptPlaylist replaces the key tags of a playlist with those of
+// reencrypt. Every segment gets its own tag, as each has its own IV. Segments
+// with keys that can not be decrypted keep their original tag.
+func reencryptPlaylist(playlist *request.Playlist) string {
+	segments := playlist.Segments()
+	var lines []string
+	n := 0
+	keyed := false
+	keyTag := ""
+	for _, line := range strings.Split(playlistText(playlist), "\n") {
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-KEY:"):
+			keyTag = line
+			continue
+		case strings.HasPrefix(line, "#EXT-X-MAP:") && keyed:
+			// Init sections are served in the clear.
+			lines = append(lines, "#EXT-X-KEY:METHOD=NONE")
+			keyed = false
+		case strings.HasPrefix(line, "#EXTINF:") && n < len(segments):
+			segment := segments[n]
+			n++
+			if undecryptable(playlist, segment.Key) {
+				lines = append(lines, keyTag)
+				keyed = true
+				break
+			}
+			index := reencrypt.playKeyIndex(segment.SeqId)
+			// Using the key lets the key endpoint serve it.
+			reencrypt.key(index)
+			lines = append(lines, fmt.Sprintf("#EXT-X-KEY:METHOD=AES-128,URI=\"%s\",IV=%s",
+				reencrypt.keyURI(index), formatIV(reencrypt.iv(segment.DiscontinuitySeq, segment.SeqId))))
+			keyed = true
 		}
+		lines = append(lines, line)
 	}
+	return strings.Join(lines, "\n")
+}
+
+// readClearFile reads a segment or init section of playlist and decrypts it.
+// With reencrypt, segments are encrypted again under its keys. It returns
+// false if filename is neither.
+func readClearFile(playlist *request.Playlist, filename string) ([]byte, bool, error) {
+	for _, segment := range playlist.Segments() {
+		if segment.URI == filename {
+			if undecryptable(playlist, segment.Key) {
+				return nil, false, nil
+			}
+			if segment.Limit > 0 {
+				return nil, true, fmt.Errorf("segments with byte ranges can not be served decrypted")
+			}
+			data, err := readSegment(playlist, segment)
+			if err == nil && reencrypt != nil {
+				key := reencrypt.key(reencrypt.playKeyIndex(segment.SeqId))
+				data, err = encryptAES128CBC(data, key, reencrypt.iv(segment.DiscontinuitySeq, segment.SeqId))
+			}
+			return data, true, err
+		}
+		if segment.Map != nil && segment.Map.URI == filename {
+			if segment.Map.Limit > 0 {
+				return nil, true, fmt.Errorf("init sections with byte ranges can not be served decrypted")
+			}
+			data, err := readInit(playlist, segment)
+			return data, true, err
+		}
+	}
+	return nil, false, nil
 }
 
 func fileHandler(w http.ResponseWriter, r *http.Request) {
-	path := strings.Trim(r.URL.Path, "/")
-	var playlist *request.Playlist
-	mutex.Lock()
-	playlist = currentPlaylist
-	mutex.Unlock()
+	serveFile(w, r, strings.Trim(r.URL.Path, "/"), sharedSource{})
+}
+
+// serveFile serves the playlist of source or one of its files.
+func serveFile(w http.ResponseWriter, r *http.Request, path string, source playlistSource) {
+	playlist := source.current()
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	if playlist == nil {
 		w.WriteHeader(404)
 		return
 	}
+	if (serveClear || reencrypt != nil) && playlist.IsLowLatency() {
+		// Parts and preload hints would still be served under the original
+		// key.
+		warnedLowLatency.Do(func() {
+			log.Printf("Warning: --decrypt and --reencrypt do not support low-latency playlists")
+		})
+		http.Error(w, "--decrypt and --reencrypt do not support low-latency playlists", 501)
+		return
+	}
 	if path == "play.m3u8" {
+		playlist, status := blockingReload(r, source, playlist)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		var text string
+		if reencrypt != nil {
+			text = reencryptPlaylist(playlist)
+		} else if serveClear {
+			text = removeKeyTags(playlist)
+		} else {
+			text = playlistText(playlist)
+		}
 		w.Header().Set("Content-Type", "application/vnd")
-		w.Write([]byte(playlist.M3U8File))
+		w.Write([]byte(deltaPlaylist(playlist, text, r.URL.Query().Get("_HLS_skip"))))
 		return
 	}
-	body := playlist.ReadFile(path)
+	if serveClear || reencrypt != nil {
+		body, ok, err := readClearFile(playlist, path)
+		if err != nil {
+			log.Printf("Warning: failed to serve %s: %s", path, err)
+			w.WriteHeader(500)
+			return
+		}
+		if ok {
+			w.Write(body)
+			return
+		}
+	}
+	body := playlistKey(playlist, path)
+	if body == nil {
+		body = playlist.ReadFile(path)
+	}
+	if body == nil && preloadHint(playlist, path) != nil {
+		// Preload hints are held until the part is available.
+		if playlist = waitPreload(source, playlist, path); playlist != nil {
+			body = playlist.ReadFile(path)
+		}
+	}
 	if body == nil {
 		w.WriteHeader(404)
 		return
 	}
-	w.Write(body)
+	// Byte ranges are supported for parts that are ranges of a segment.
+	http.ServeContent(w, r, path, time.Time{}, bytes.NewReader(body))
 }
 
 func play(cmd *cobra.Command, args []string) {
@@ -96,10 +295,44 @@ func play(cmd *cobra.Command, args []string) {
 	metadata, _ := cmd.Flags().GetString("metadata")
 	starttime, _ := cmd.Flags().GetInt("starttime")
 	listen, _ := cmd.Flags().GetString("listen")
-	go updatePlaylist(realtime, starttime, metadata, fileDir)
+	client, _ := cmd.Flags().GetString("client")
+	serveClear, _ = cmd.Flags().GetBool("decrypt")
+	rewriteURIs, _ = cmd.Flags().GetBool("rewrite-uris")
+	sessionTimeout, _ = cmd.Flags().GetDuration("session-timeout")
+	maxSessions, _ = cmd.Flags().GetInt("max-sessions")
+	controlToken, _ = cmd.Flags().GetString("control-token")
+	if sessionTimeout <= 0 {
+		log.Fatal("--session-timeout must be positive")
+	}
+	err := setupKeys(cmd)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = setupReencrypt(cmd)
+	if err != nil {
+		log.Fatal(err)
+	}
+	recording = openTimeline(metadata, fileDir, client)
+	if !realtime {
+		playback = newPlayClock(starttime)
+	}
+	if controlToken == "" {
+		controlToken = randomHex(16)
+		log.Printf("control token: %s", controlToken)
+	}
+	go updatePlaylist()
+	go expireSessions(sessionTimeout)
 
+	if reencrypt != nil {
+		http.HandleFunc("/keys/", keyHandler(reencrypt.Token, func(name string, index int) []byte {
+			return reencrypt.servedKey(index)
+		}))
+	}
+	http.HandleFunc("/_control", controlHandler)
+	http.HandleFunc("/_control/", controlHandler)
+	http.HandleFunc("/s/", sessionHandler)
 	http.HandleFunc("/", fileHandler)
-	err := http.ListenAndServe(listen, nil)
+	err = http.ListenAndServe(listen, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -126,4 +359,12 @@ func init() {
 	// playCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 	playCmd.Flags().Bool("realtime", false, "Play a live streaming that is being recorded")
 	playCmd.Flags().Int("starttime", 0, "Seconds since the first timestamp after which playing starts.")
+	playCmd.Flags().String("client", "", "Only play requests of this client address or proxy user")
+	playCmd.Flags().Bool("decrypt", false, "Serve decrypted segments and playlists without key tags, except for low-latency playlists")
+	playCmd.Flags().String("control-token", "", "Token /_control actions require as ?token= or bearer token, generated if empty")
+	playCmd.Flags().Duration("session-timeout", 5 * time.Minute, "Time after which sessions created with /s/{id}/play.m3u8 expire when idle")
+	playCmd.Flags().Int("max-sessions", 64, "Maximum number of sessions created with /s/{id}/play.m3u8 at a time")
+	playCmd.Flags().Bool("rewrite-uris", false, "Serve the captured playlists with only their URIs rewritten, keeping all other tags as they are")
+	addKeyFlags(playCmd)
+	addReencryptFlags(playCmd, "/keys")
 }
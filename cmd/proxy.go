@@ -2,28 +2,31 @@ package cmd
 
 import (
 	"log"
-	"os"
 	"time"
 	"sync"
 	"strings"
-	"path"
 	"net/http"
 	"net/url"
-	"io/ioutil"
-	"encoding/json"
+	"context"
+	"io"
 
 	"github.com/spf13/cobra"
 
 	"hlsrecorder/request"
 )
 
+// FileCache maps downloaded URIs to their requests. Mutex also guards the
+// requests of database.
 type FileCache struct {
 	Mutex sync.Mutex
 	Files map[string]int
+	// Preloading holds the URIs of preload hints that are being downloaded.
+	Preloading map[string]bool
 }
 
 var m3u8URI string
 var cookies string
+var handoff *streamHandoff
 var database *request.RequestDatabase
 var fileCache *FileCache
 
@@ -36,81 +39,138 @@ func download(requests *request.RequestDatabase, currURI, uri string, needBody b
 	if err != nil {
 		return nil, -1, err
 	}
-	var downloadURI string
-	if parsedURI.Scheme == "" && parsedURI.Host == "" {
-		parsedCurrURI.Path = path.Join(path.Dir(parsedCurrURI.Path), uri)
-		downloadURI = parsedCurrURI.String()
-	} else {
-		downloadURI = uri
-	}
-	if idx, ok := fileCache.Files[downloadURI]; ok {
+	downloadURI := parsedCurrURI.ResolveReference(parsedURI).String()
+	fileCache.Mutex.Lock()
+	cachedIdx, ok := fileCache.Files[downloadURI]
+	fileCache.Mutex.Unlock()
+	if ok {
 		var body []byte = nil
 		if needBody {
-			body = requests.ReadBody(idx)
+			body = requests.ReadBody(cachedIdx)
 		}
-		return body, idx, nil
+		return body, cachedIdx, nil
 	} 
 	log.Printf("download: %s", uri)
-	req, err := http.NewRequest(http.MethodGet, downloadURI, nil)
+	timing := newTransferTiming()
+	req, err := http.NewRequestWithContext(timing.withTrace(context.Background()),
+											http.MethodGet, downloadURI, nil)
 	if err != nil {
 		return nil, -1, err
 	}
+	if handoff != nil {
+		handoff.apply(req)
+	}
 	if cookies != "" {
 		req.Header.Set("Cookie", cookies)
 	}
-	res, err := http.DefaultClient.Do(req)
+	res, err := httpClient.Do(req)
 	if err != nil {
 		return nil, -1, err
 	}
+	defer res.Body.Close()
+	headerTime := time.Now().UnixMicro()
 	noCache := false
 	header := res.Header.Get("Cache-Control")
 	if strings.Contains(header, "no-cache") {
 		noCache = true
 	}
-	body, err := ioutil.ReadAll(res.Body)
+	id := randomHex(16)
+	c, err := newCapture(defaultSession.FileDir, id)
 	if err != nil {
+		log.Printf("Warning: failed to save %s: %s", downloadURI, err)
 		return nil, -1, err
 	}
-	id := randomHex(16)
-	metadata := request.Metadata {
-		Host: req.Host,
-		URI: downloadURI,
-		Time: time.Now().UnixMicro(),
-		Id: id,
+	_, err = io.Copy(c, res.Body)
+	if err != nil {
+		c.abort()
+		return nil, -1, err
 	}
-	filename := fileDir + "/" + id
-	err = os.WriteFile(filename, body, 0644)
+	contentEncoding := res.Header.Get("Content-Encoding")
+	err = c.finish(contentEncoding)
 	if err != nil {
 		log.Printf("Warning: failed to save %s: %s", downloadURI, err)
 		return nil, -1, err
 	}
-	metadataEncoder.Encode(metadata)
+	if c.DecodeErr != nil {
+		log.Printf("Warning: failed to decode %s body of %s, storing it as it was sent: %s",
+			contentEncoding, downloadURI, c.DecodeErr)
+	}
+	metadata := request.Metadata {
+		Host: req.Host,
+		URI: downloadURI,
+		Id: id,
+		Status: res.StatusCode,
+		Location: res.Header.Get("Location"),
+		ContentLength: res.ContentLength,
+		ContentEncoding: contentEncoding,
+	}
+	c.fill(&metadata)
+	timing.fill(&metadata, headerTime)
+	defaultSession.save(metadata)
+	// Preload hints are downloaded concurrently, so the database is
+	// guarded by fileCache.Mutex.
 	idx := requests.AddRequest(metadata)
-	if !noCache {
+	if !noCache && res.StatusCode == http.StatusOK {
 		fileCache.Mutex.Lock()
 		fileCache.Files[downloadURI] = idx
 		fileCache.Mutex.Unlock()
 	}
+	var body []byte = nil
+	if needBody {
+		body = requests.ReadBody(idx)
+	}
 	return body, idx, nil
 }
 
+// preload downloads the resources of the preload hints of a playlist in the
+// background, so that they are recorded as soon as the server has them.
+func preload(playlist *request.Playlist) {
+	for _, hint := range playlist.PreloadHints {
+		fileCache.Mutex.Lock()
+		started := fileCache.Preloading[hint.URI]
+		fileCache.Preloading[hint.URI] = true
+		fileCache.Mutex.Unlock()
+		if started {
+			continue
+		}
+		go func(uri string) {
+			_, _, err := download(database, m3u8URI, uri, false)
+			if err != nil {
+				log.Printf("Warning: failed to preload %s: %s", uri, err)
+			}
+			// Failed preloads are retried with the next playlist.
+			fileCache.Mutex.Lock()
+			delete(fileCache.Preloading, uri)
+			fileCache.Mutex.Unlock()
+		}(hint.URI)
+	}
+}
+
 func updateProxiedPlaylist() error {
 	last := time.Now().UnixMicro()
+	var previous *request.Playlist
 	for {
-		playlist, err := request.LoadRemotePlaylist(database, download, m3u8URI)
+		// Servers that support blocking reloads answer when the next part
+		// or segment is available.
+		uri := blockingReloadURI(m3u8URI, previous)
+		playlist, err := request.LoadRemotePlaylist(database, download, uri)
+		progressed := playlist != nil && previous != nil && playlist.Newer(previous)
 		if playlist != nil {
-			mutex.Lock()
-			currentPlaylist = playlist
-			mutex.Unlock()
+			warnUnsupportedKeys(playlist)
+			preload(playlist)
+			setCurrentPlaylist(playlist)
+			previous = playlist
 		}
 		if err != nil {
 			log.Printf("Warning: failed to load playlist: %s", err)
+			previous = nil
 		}
 		now := time.Now().UnixMicro()
 		diff := now - last
 		last = now
-		if diff < 1000000 {
-			time.Sleep(time.Duration(1000000 - diff) * time.Microsecond)
+		interval := pollInterval(previous).Microseconds()
+		if !(uri != m3u8URI && progressed) && diff < interval {
+			time.Sleep(time.Duration(interval - diff) * time.Microsecond)
 		}
 	}
 }
@@ -120,18 +180,43 @@ func proxy(cmd *cobra.Command, args []string) {
 	metadata, _ := cmd.Flags().GetString("metadata")
 	listen, _ := cmd.Flags().GetString("listen")
 	cookies, _ = cmd.Flags().GetString("cookies")
-	m3u8URI = args[0]
-	os.Mkdir(fileDir, 0755)
-
-	metadataFile, err := os.OpenFile(metadata, os.O_APPEND | os.O_WRONLY | os.O_CREATE, 0600)
+	maxBodySize, _ = cmd.Flags().GetInt64("max-body-size")
+	handoffFile, _ := cmd.Flags().GetString("handoff")
+	upstreamProxy, _ := cmd.Flags().GetString("upstream-proxy")
+	upstreamBypass, _ := cmd.Flags().GetStringSlice("upstream-bypass")
+	err := setupUpstream(upstreamProxy, upstreamBypass)
+	if err != nil {
+		log.Fatal(err)
+	}
+	serveClear, _ = cmd.Flags().GetBool("decrypt")
+	rewriteURIs, _ = cmd.Flags().GetBool("rewrite-uris")
+	err = setupKeys(cmd)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if handoffFile != "" {
+		handoff, err = readStreamHandoff(handoffFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		m3u8URI = handoff.URI
+	}
+	if len(args) > 0 {
+		m3u8URI = args[0]
+	}
+	if m3u8URI == "" {
+		log.Fatal("either a URI or --handoff is required")
+	}
+	defaultSession, err = openRecordingSession(metadata, fileDir)
 	if err != nil {
 		log.Fatal(err)
 	}
-	metadataEncoder = json.NewEncoder(metadataFile)
 	database = request.NewRequestDatabase(fileDir) 
 	fileCache = &FileCache {
 		Files: make(map[string]int),
+		Preloading: make(map[string]bool),
 	}
+	database.Locker = &fileCache.Mutex
 	go updateProxiedPlaylist()
 
 	http.HandleFunc("/", fileHandler)
@@ -143,9 +228,9 @@ func proxy(cmd *cobra.Command, args []string) {
 
 // proxyCmd represents the proxy command
 var proxyCmd = &cobra.Command{
-	Use:   "proxy",
+	Use:   "proxy [URI]",
 	Short: "Record and proxy HLS live streaming automatically with a URI",
-	Args: cobra.MinimumNArgs(1),
+	Args: cobra.MaximumNArgs(1),
 	Run: proxy,
 }
 
@@ -163,4 +248,10 @@ func init() {
 	// proxyCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 	proxyCmd.Flags().String("uri", "", "m3u8 URI")
 	proxyCmd.Flags().String("cookies", "", "cookies for sending requests")
+	proxyCmd.Flags().String("handoff", "", "stream handoff file written by record")
+	addUpstreamFlags(proxyCmd)
+	proxyCmd.Flags().Bool("decrypt", false, "Serve decrypted segments and playlists without key tags")
+	proxyCmd.Flags().Bool("rewrite-uris", false, "Serve the captured playlists with only their URIs rewritten, keeping all other tags as they are")
+	addKeyFlags(proxyCmd)
+	proxyCmd.Flags().Int64("max-body-size", 0, "Maximum number of bytes saved per response, 0 for no limit")
 }
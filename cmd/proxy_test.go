@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"testing"
+	"net/http"
+	"net/http/httptest"
+
+	"hlsrecorder/request"
+)
+
+// setupProxy points the proxy at the playlist of origin, recording to a
+// temporary directory.
+func setupProxy(t *testing.T, uri string) {
+	dir := t.TempDir()
+	session, err := openRecordingSession(dir + "/metadata.json", dir + "/files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		session.File.Close()
+	})
+	defaultSession = session
+	database = request.NewRequestDatabase(dir + "/files")
+	fileCache = &FileCache {
+		Files: make(map[string]int),
+		Preloading: make(map[string]bool),
+	}
+	database.Locker = &fileCache.Mutex
+	m3u8URI = uri
+}
+
+// waitPreloads waits until no preload is running.
+func waitPreloads(t *testing.T) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fileCache.Mutex.Lock()
+		running := len(fileCache.Preloading)
+		fileCache.Mutex.Unlock()
+		if running == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d preloads still running", running)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPreload(t *testing.T) {
+	tests := []struct {
+		name string
+		hint string
+		// recorded is whether the hint is recorded.
+		recorded bool
+	} {
+		{"available", "part2.ts", true},
+		{"failing", "http://127.0.0.1:1/part2.ts", false},
+	}
+	for _, test := range tests {
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/live/index.m3u8" {
+				fmt.Fprintf(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-PART-INF:PART-TARGET=1\n" +
+					"#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PART:DURATION=1,URI=\"part1.ts\"\n" +
+					"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s\"\n", test.hint)
+				return
+			}
+			fmt.Fprintf(w, "body of %s", r.URL.Path)
+		}))
+		setupProxy(t, origin.URL + "/live/index.m3u8")
+
+		// Preloads run while playlists are loaded and files are served, as
+		// they do in the proxy.
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				playlist, err := request.LoadRemotePlaylist(database, download, m3u8URI)
+				if err != nil {
+					t.Errorf("%s: %s", test.name, err)
+					return
+				}
+				preload(playlist)
+				setCurrentPlaylist(playlist)
+			}()
+			go func() {
+				defer wg.Done()
+				for _, path := range []string{"/play.m3u8", "/part1.ts", "/part2.ts"} {
+					fileHandler(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+				}
+			}()
+		}
+		wg.Wait()
+		waitPreloads(t)
+
+		uri := origin.URL + "/live/" + test.hint
+		if !test.recorded {
+			uri = test.hint
+		}
+		fileCache.Mutex.Lock()
+		_, recorded := fileCache.Files[uri]
+		fileCache.Mutex.Unlock()
+		if recorded != test.recorded {
+			t.Errorf("%s: got recorded %t, want %t", test.name, recorded, test.recorded)
+		}
+		origin.Close()
+	}
+}
@@ -1,8 +1,6 @@
 package cmd
 
 import (
-	"bytes"
-	"io"
 	"os"
 	"time"
 	"net"
@@ -11,7 +9,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/rand"
-	"encoding/json"
+	"strings"
 	"encoding/hex"
 
 	"github.com/spf13/cobra"
@@ -23,10 +21,10 @@ import (
 	"hlsrecorder/request"
 )
 
-var metadataFile *os.File
-var metadataEncoder *json.Encoder
 var fileDir string
 
+const apiHost = "gomitmproxy"
+
 func record(cmd *cobra.Command, args []string) {
 	key, _ := cmd.Flags().GetString("key")
 	crt, _ := cmd.Flags().GetString("crt")
@@ -35,14 +33,45 @@ func record(cmd *cobra.Command, args []string) {
 	listen, _ := cmd.Flags().GetString("listen")
 	username, _ := cmd.Flags().GetString("username")
 	password, _ := cmd.Flags().GetString("password")
+	users, _ := cmd.Flags().GetStringArray("user")
+	maxBodySize, _ = cmd.Flags().GetInt64("max-body-size")
+	splitSessions, _ = cmd.Flags().GetString("split-sessions")
+	sessionsDir, _ = cmd.Flags().GetString("sessions-dir")
+	statusListen, _ := cmd.Flags().GetString("status-listen")
+	detectedStreams.Token, _ = cmd.Flags().GetString("status-token")
+	handoffDir, _ = cmd.Flags().GetString("handoff-dir")
+	upstreamProxy, _ := cmd.Flags().GetString("upstream-proxy")
+	upstreamBypass, _ := cmd.Flags().GetStringSlice("upstream-bypass")
 
-	os.Mkdir(fileDir, 0755)
+	if splitSessions != "" && splitSessions != "client" && splitSessions != "user" {
+		log.Fatal("--split-sessions must be client or user")
+	}
+	if username != "" {
+		proxyUsers[username] = password
+	}
+	for _, user := range users {
+		name, password, ok := strings.Cut(user, ":")
+		if !ok {
+			log.Fatal("--user must be name:password")
+		}
+		proxyUsers[name] = password
+	}
+	if splitSessions == "user" && len(proxyUsers) == 0 {
+		log.Fatal("--split-sessions user requires proxy users")
+	}
 
-	metadataFile, err := os.OpenFile(metadata, os.O_APPEND | os.O_WRONLY | os.O_CREATE, 0600)
+	var err error
+	defaultSession, err = openRecordingSession(metadata, fileDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if handoffDir != "" {
+		os.MkdirAll(handoffDir, 0700)
+	}
+	err = setupUpstream(upstreamProxy, upstreamBypass)
 	if err != nil {
 		log.Fatal(err)
 	}
-	metadataEncoder = json.NewEncoder(metadataFile)
 
 	tlsCert, err := tls.LoadX509KeyPair(crt, key)
 	if err != nil {
@@ -66,6 +95,21 @@ func record(cmd *cobra.Command, args []string) {
 	// Set certs organization.
 	mitmConfig.SetOrganization("gomitmproxy")
 
+	go detectedStreams.printStreams(5 * time.Second)
+	if statusListen != "" {
+		statusListen = loopbackAddr(statusListen)
+		if detectedStreams.Token == "" {
+			detectedStreams.Token = randomHex(16)
+			log.Printf("status page token: %s", detectedStreams.Token)
+		}
+		go func() {
+			err := http.ListenAndServe(statusListen, detectedStreams)
+			if err != nil {
+				log.Printf("Warning: status endpoint failed: %s", err)
+			}
+		}()
+	}
+
 	listener, err := net.Listen("tcp", listen)
 	
 	if err != nil {
@@ -73,11 +117,11 @@ func record(cmd *cobra.Command, args []string) {
 	}
 
 	proxy := gomitmproxy.NewProxy(gomitmproxy.Config{
-		APIHost:	"gomitmproxy",
+		APIHost:	apiHost,
 		MITMConfig:	mitmConfig,
+		OnConnect:	onConnect,
+		OnRequest:	onRequest,
 		OnResponse:	onResponse,
-		Username: username,
-		Password: password,
 	})
 
 	proxy.Serve(listener)
@@ -89,33 +133,125 @@ func randomHex(n int) string {
 	return hex.EncodeToString(bytes)
 }
 
+func onRequest(session *gomitmproxy.Session) (*http.Request, *http.Response) {
+	req := session.Request()
+	// Proxy authorization is done here instead of by gomitmproxy so that
+	// multiple users can be told apart.
+	if len(proxyUsers) > 0 {
+		var user string
+		var ok bool
+		if session.Ctx().IsMITM() {
+			user = lookupUser(req.RemoteAddr)
+			ok = user != ""
+		} else {
+			user, ok = authorizeUser(req)
+			if req.Method == http.MethodConnect {
+				rememberUser(req.RemoteAddr, user)
+			}
+		}
+		if !ok {
+			res := proxyutil.NewResponse(http.StatusProxyAuthRequired, nil, req)
+			res.Header.Set("Proxy-Authenticate", "Basic")
+			session.SetProp("unauthorized", true)
+			return nil, res
+		}
+		session.SetProp("user", user)
+	}
+	if req.Method == http.MethodConnect {
+		return nil, nil
+	}
+	timing := newTransferTiming()
+	session.SetProp("timing", timing)
+	req = req.WithContext(timing.withTrace(req.Context()))
+	// gomitmproxy can't be given an upstream proxy, so requests that have to
+	// go through one are sent from here.
+	if upstream != nil && req.Host != apiHost && req.Header.Get("Upgrade") == "" {
+		return nil, roundTripUpstream(req)
+	}
+	return req, nil
+}
+
+func roundTripUpstream(req *http.Request) *http.Response {
+	outReq := req.Clone(req.Context())
+	outReq.RequestURI = ""
+	removeHopByHopHeaders(outReq.Header)
+	res, err := httpClient.Transport.RoundTrip(outReq)
+	if err != nil {
+		log.Printf("Warning: failed to send %s upstream: %s", req.URL, err)
+		return proxyutil.NewErrorResponse(req, err)
+	}
+	removeHopByHopHeaders(res.Header)
+	return res
+}
+
+func onConnect(session *gomitmproxy.Session, proto string, addr string) net.Conn {
+	if upstream == nil || upstream.bypasses(addr) {
+		return nil
+	}
+	conn, err := upstream.dial(proto, addr)
+	if err != nil {
+		log.Printf("Warning: failed to connect to %s upstream: %s", addr, err)
+		// gomitmproxy connects directly if no connection is returned.
+		return failedConn{Err: err}
+	}
+	return conn
+}
+
 func onResponse(session *gomitmproxy.Session) *http.Response {
 	res := session.Response()
 	req := session.Request()
 	uri := req.URL.String()
 	log.Printf("onResponse: %s", uri)
 
-	body, err := io.ReadAll(res.Body)
-	res.Body.Close()
-	if err != nil {
-		return proxyutil.NewErrorResponse(req, err)
+	if _, ok := session.GetProp("unauthorized"); ok {
+		return nil
+	}
+	headerTime := time.Now().UnixMicro()
+	contentEncoding := res.Header.Get("Content-Encoding")
+	contentType := res.Header.Get("Content-Type")
+	user := ""
+	if prop, ok := session.GetProp("user"); ok {
+		user = prop.(string)
 	}
-	res.Body = io.NopCloser(bytes.NewReader(body))
+	client := clientHost(req.RemoteAddr)
+	recordingSession := sessionFor(client, user)
 	id := randomHex(16)
 	metadata := request.Metadata {
 		Host: req.Host,
 		URI: uri,
-		Time: time.Now().UnixMicro(),
 		Id: id,
 		Status: res.StatusCode,
 		Location: res.Header.Get("Location"),
+		ContentLength: res.ContentLength,
+		ContentEncoding: contentEncoding,
+		Client: client,
+		User: user,
 	}
-	filename := fileDir + "/" + id
-	err = os.WriteFile(filename, body, 0644)
+	if timing, ok := session.GetProp("timing"); ok {
+		timing.(*transferTiming).fill(&metadata, headerTime)
+	}
+	err := newTeeResponse(res, recordingSession.FileDir, id, func(c *capture, err error) {
+		if err != nil {
+			log.Printf("Warning: failed to receive %s: %s", uri, err)
+		}
+		err = c.finish(contentEncoding)
+		if err != nil {
+			log.Printf("Warning: failed to save %s: %s", uri, err)
+		}
+		if c.DecodeErr != nil {
+			log.Printf("Warning: failed to decode %s body of %s, storing it as it was sent: %s",
+				contentEncoding, uri, c.DecodeErr)
+		}
+		c.fill(&metadata)
+		recordingSession.save(metadata)
+		if err == nil && !metadata.Encoded && isPlaylistResponse(metadata, contentType) {
+			detectedStreams.inspect(metadata, recordingSession.FileDir + "/" + id, req.Header)
+		}
+	})
 	if err != nil {
 		log.Printf("Warning: failed to save %s: %s", uri, err)
+		return nil
 	}
-	metadataEncoder.Encode(metadata)
 	return res
 }
 
@@ -140,4 +276,12 @@ func init() {
 	// recordCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 	recordCmd.Flags().String("username", "", "Proxy username")
 	recordCmd.Flags().String("password", "", "Proxy password")
+	recordCmd.Flags().StringArray("user", nil, "Additional proxy user as name:password, can be repeated")
+	recordCmd.Flags().String("split-sessions", "", "Record each client or user to its own session directory (client, user)")
+	recordCmd.Flags().String("sessions-dir", "sessions/", "Directory for split sessions")
+	recordCmd.Flags().String("status-listen", "", "listen addr of the detected streams status page, e.g. :8081, which binds to loopback unless a host is given")
+	recordCmd.Flags().String("status-token", "", "token required by the status page as ?token= or bearer token, random if not given")
+	recordCmd.Flags().String("handoff-dir", "", "Write stream handoff files for proxy to this directory")
+	addUpstreamFlags(recordCmd)
+	recordCmd.Flags().Int64("max-body-size", 0, "Maximum number of bytes saved per response, 0 for no limit")
 }
@@ -0,0 +1,298 @@
+package cmd
+
+import (
+	"os"
+	"fmt"
+	"log"
+	"sync"
+	"regexp"
+	"strings"
+	"net/url"
+	"net/http"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+
+	"github.com/spf13/cobra"
+)
+
+// reencryption encrypts served or exported segments with AES-128 under new
+// keys, so that the original keys are not exposed.
+type reencryption struct {
+	Mutex sync.Mutex
+	// Supplied keys are used in turn, otherwise keys are generated.
+	Supplied [][]byte
+	Generated map[int][]byte
+	// Used is the number of keys used so far.
+	Used int
+	// Rotation is the number of segments per key, 0 to use one key.
+	Rotation int
+	// Periods numbers the rotation periods of the segments play served in
+	// the order they were first served.
+	Periods map[uint64]int
+	KeyURL *url.URL
+	Token string
+	// IVs are derived from the position of a segment with this cipher, so
+	// that they are the same whenever a segment is served.
+	IVCipher cipher.Block
+}
+
+// reencrypt is nil unless --reencrypt is given.
+var reencrypt *reencryption
+
+func randomBytes(n int) []byte {
+	data := make([]byte, n)
+	_, err := rand.Read(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return data
+}
+
+// keyIndex returns the index of the key of the nth segment.
+func (r *reencryption) keyIndex(n uint64) int {
+	if r.Rotation <= 0 {
+		return 0
+	}
+	return int(n / uint64(r.Rotation))
+}
+
+// playKeyIndex returns the index of the key of segment seqId served by play.
+// Keys are numbered from the first segment served, so that play does not start
+// at a high index with a live stream far into its media sequence.
+func (r *reencryption) playKeyIndex(seqId uint64) int {
+	period := uint64(0)
+	if r.Rotation > 0 {
+		period = seqId / uint64(r.Rotation)
+	}
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	index, ok := r.Periods[period]
+	if !ok {
+		index = len(r.Periods)
+		r.Periods[period] = index
+	}
+	return index
+}
+
+func (r *reencryption) key(index int) []byte {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	if index >= r.Used {
+		r.Used = index + 1
+	}
+	if len(r.Supplied) > 0 {
+		return r.Supplied[index % len(r.Supplied)]
+	}
+	key, ok := r.Generated[index]
+	if !ok {
+		key = randomBytes(aes.BlockSize)
+		r.Generated[index] = key
+	}
+	return key
+}
+
+// servedKey returns a key that is in use, or nil.
+func (r *reencryption) servedKey(index int) []byte {
+	r.Mutex.Lock()
+	used := r.Used
+	r.Mutex.Unlock()
+	if index >= used {
+		return nil
+	}
+	return r.key(index)
+}
+
+// iv returns the IV of a segment.
+func (r *reencryption) iv(discontinuitySeq, seqId uint64) []byte {
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv, discontinuitySeq)
+	binary.BigEndian.PutUint64(iv[8:], seqId)
+	r.IVCipher.Encrypt(iv, iv)
+	return iv
+}
+
+func reencryptionKeyName(index int) string {
+	return fmt.Sprintf("key_%d.key", index)
+}
+
+const keyTokenFile = "token"
+
+var reencryptionKeyPattern = regexp.MustCompile(`^key_([0-9]+)\.key$`)
+
+// keyURI returns the URI of a key under KeyURL. The token is added to the
+// query, as players fetch keys with the URI of the playlist only.
+func (r *reencryption) keyURI(index int) string {
+	uri := *r.KeyURL
+	uri.Path = strings.TrimSuffix(uri.Path, "/") + "/" + reencryptionKeyName(index)
+	uri.RawPath = ""
+	query := uri.Query()
+	query.Set("token", r.Token)
+	uri.RawQuery = query.Encode()
+	return uri.String()
+}
+
+// encryptAES128CBC encrypts data with PKCS#7 padding.
+func encryptAES128CBC(data, key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(data) % aes.BlockSize
+	encrypted := make([]byte, len(data) + padding)
+	copy(encrypted, data)
+	for i := len(data); i < len(encrypted); i++ {
+		encrypted[i] = byte(padding)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+	return encrypted, nil
+}
+
+// writeKeys writes the keys used so far and the token to dir, and returns the
+// number of keys.
+func (r *reencryption) writeKeys(dir string) (int, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return 0, err
+	}
+	r.Mutex.Lock()
+	used := r.Used
+	r.Mutex.Unlock()
+	for i := 0; i < used; i++ {
+		err = os.WriteFile(dir + "/" + reencryptionKeyName(i), r.key(i), 0600)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return used, os.WriteFile(dir + "/" + keyTokenFile, []byte(r.Token), 0600)
+}
+
+// checkToken tells whether a request carries token as bearer token or token
+// query parameter.
+func checkToken(req *http.Request, token string) bool {
+	given := req.URL.Query().Get("token")
+	if header := req.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		given = strings.TrimPrefix(header, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// keyHandler serves the keys named by reencryptionKeyName behind a token.
+// read returns nil for unknown keys.
+func keyHandler(token string, read func(name string, index int) []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization")
+		w.Header().Set("Cache-Control", "no-store")
+		if req.Method == http.MethodOptions {
+			return
+		}
+		if !checkToken(req, token) {
+			w.WriteHeader(403)
+			return
+		}
+		name := req.URL.Path[strings.LastIndex(req.URL.Path, "/") + 1:]
+		match := reencryptionKeyPattern.FindStringSubmatch(name)
+		if match == nil {
+			w.WriteHeader(404)
+			return
+		}
+		var index int
+		fmt.Sscan(match[1], &index)
+		key := read(name, index)
+		if key == nil {
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(key)
+	}
+}
+
+func addReencryptFlags(cmd *cobra.Command, keyURL string) {
+	cmd.Flags().Bool("reencrypt", false, "Encrypt segments with AES-128 under new keys instead of the original ones")
+	cmd.Flags().StringArray("reencrypt-key", nil, "Key to re-encrypt with as hex, can be repeated to use the keys in turn. Keys are generated if none are given")
+	cmd.Flags().Int("key-rotation", 0, "With --reencrypt, use a new key every N segments, 0 for one key")
+	cmd.Flags().String("key-url", keyURL, "With --reencrypt, URL the key endpoint serves the keys at, its query is kept in the key URIs")
+	cmd.Flags().String("key-token", "", "Token the key endpoint requires as ?token= or bearer token, added to the key URIs, generated if empty")
+}
+
+// setupReencrypt sets reencrypt from the re-encryption flags.
+func setupReencrypt(cmd *cobra.Command) error {
+	enabled, _ := cmd.Flags().GetBool("reencrypt")
+	keys, _ := cmd.Flags().GetStringArray("reencrypt-key")
+	rotation, _ := cmd.Flags().GetInt("key-rotation")
+	keyURL, _ := cmd.Flags().GetString("key-url")
+	token, _ := cmd.Flags().GetString("key-token")
+	if !enabled {
+		return nil
+	}
+	parsedURL, err := url.Parse(keyURL)
+	if err != nil {
+		return fmt.Errorf("invalid --key-url: %s", err)
+	}
+	block, err := aes.NewCipher(randomBytes(aes.BlockSize))
+	if err != nil {
+		return err
+	}
+	reencrypt = &reencryption {
+		Generated: make(map[int][]byte),
+		Rotation: rotation,
+		Periods: make(map[uint64]int),
+		KeyURL: parsedURL,
+		Token: token,
+		IVCipher: block,
+	}
+	for _, value := range keys {
+		key, err := parseKey(value)
+		if err != nil {
+			return err
+		}
+		reencrypt.Supplied = append(reencrypt.Supplied, key)
+	}
+	if reencrypt.Token == "" {
+		reencrypt.Token = randomHex(16)
+		log.Printf("key token: %s", reencrypt.Token)
+	}
+	return nil
+}
+
+func serveKeys(cmd *cobra.Command, args []string) {
+	dir, _ := cmd.Flags().GetString("dir")
+	token, _ := cmd.Flags().GetString("key-token")
+	listen, _ := cmd.Flags().GetString("listen")
+	if token == "" {
+		data, err := os.ReadFile(dir + "/" + keyTokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	http.HandleFunc("/", keyHandler(token, func(name string, index int) []byte {
+		key, err := os.ReadFile(dir + "/" + name)
+		if err != nil {
+			return nil
+		}
+		return key
+	}))
+	err := http.ListenAndServe(listen, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serveKeysCmd represents the serve-keys command
+var serveKeysCmd = &cobra.Command{
+	Use:   "serve-keys",
+	Short: "Serve the keys of a re-encrypted export behind a token",
+	Run: serveKeys,
+}
+
+func init() {
+	rootCmd.AddCommand(serveKeysCmd)
+
+	serveKeysCmd.Flags().String("dir", "output-keys", "Directory dump --reencrypt wrote the keys to")
+	serveKeysCmd.Flags().String("key-token", "", "Token required as ?token= or bearer token, read from the token file of --dir if empty")
+}
@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"os"
+	"bytes"
+	"regexp"
+	"testing"
+	"net/url"
+	"net/http"
+	"io/ioutil"
+	"crypto/aes"
+	"net/http/httptest"
+
+	"hlsrecorder/request"
+)
+
+// testPlaylist records a clear media playlist of two segments.
+func testPlaylist(t *testing.T) *request.Playlist {
+	dir := t.TempDir()
+	database := request.NewRequestDatabase(dir)
+	files := []struct {
+		uri string
+		body string
+	} {
+		{"http://example.com/live/seg0.ts", "segment 0"},
+		{"http://example.com/live/seg1.ts", "segment 1"},
+		{"http://example.com/live/index.m3u8", "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:0\n" +
+			"#EXTINF:2,\nseg0.ts\n#EXTINF:2,\nseg1.ts\n"},
+	}
+	for i, file := range files {
+		id := randomHex(16)
+		err := os.WriteFile(dir + "/" + id, []byte(file.body), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		database.AddRequest(request.Metadata {
+			Host: "example.com",
+			URI: file.uri,
+			Time: int64(1700000000000000 + i * 1000000),
+			Id: id,
+			Status: 200,
+		})
+	}
+	playlist, _, err := request.LoadPlaylist(database, 0, false, -1)
+	if err != nil || playlist == nil {
+		t.Fatalf("failed to load playlist: %v", err)
+	}
+	return playlist
+}
+
+var keyURIPattern = regexp.MustCompile(`#EXT-X-KEY:METHOD=AES-128,URI="([^"]*)"`)
+
+func TestReencryptKeyURI(t *testing.T) {
+	defer func() {
+		reencrypt = nil
+	}()
+	tests := []struct {
+		name string
+		keyURL string
+		query url.Values
+	} {
+		{"relative", "/keys", url.Values{}},
+		{"trailing slash", "/keys/", url.Values{}},
+		{"query", "/keys?kid=7", url.Values{"kid": {"7"}}},
+		{"absolute", "SERVER/keys", url.Values{}},
+	}
+	for _, test := range tests {
+		reencrypt = &reencryption {
+			Generated: make(map[int][]byte),
+			Periods: make(map[uint64]int),
+			Token: "secret",
+		}
+		block, _ := aes.NewCipher(make([]byte, aes.BlockSize))
+		reencrypt.IVCipher = block
+		mux := http.NewServeMux()
+		mux.HandleFunc("/keys/", keyHandler(reencrypt.Token, func(name string, index int) []byte {
+			return reencrypt.servedKey(index)
+		}))
+		server := httptest.NewServer(mux)
+		keyURL, err := url.Parse(regexp.MustCompile("^SERVER").ReplaceAllString(test.keyURL, server.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reencrypt.KeyURL = keyURL
+
+		text := reencryptPlaylist(testPlaylist(t))
+		match := keyURIPattern.FindStringSubmatch(text)
+		if match == nil {
+			t.Errorf("%s: no key tag in\n%s", test.name, text)
+			server.Close()
+			continue
+		}
+		uri, err := url.Parse(match[1])
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			server.Close()
+			continue
+		}
+		for name, values := range test.query {
+			if got := uri.Query()[name]; len(got) != 1 || got[0] != values[0] {
+				t.Errorf("%s: key URI %s lost %s=%s", test.name, uri, name, values[0])
+			}
+		}
+		base, _ := url.Parse(server.URL + "/live/play.m3u8")
+		resp, err := http.Get(base.ResolveReference(uri).String())
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			server.Close()
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 || !bytes.Equal(body, reencrypt.key(0)) {
+			t.Errorf("%s: fetching %s returned %d % x", test.name, uri, resp.StatusCode, body)
+		}
+		server.Close()
+	}
+}
@@ -0,0 +1,601 @@
+package cmd
+
+import (
+	"os"
+	"io"
+	"log"
+	"fmt"
+	"math"
+	"encoding/binary"
+
+	"hlsrecorder/mp4"
+	"hlsrecorder/mpegts"
+)
+
+const timestampWrap = int64(1) << 33
+
+// remuxSample is a sample with decode and presentation time in the timescale
+// of its track.
+type remuxSample struct {
+	DTS int64
+	PTS int64
+	Sync bool
+	Data []byte
+}
+
+// remuxTrack collects the samples of one elementary stream.
+type remuxTrack struct {
+	Track *mp4.Track
+	StreamType uint8
+	// ParameterSets holds the parameter sets of the sample entry, which are
+	// dropped from the samples.
+	ParameterSets map[string]bool
+	Pending []remuxSample
+	// End is the decode time the next sample is expected at.
+	End int64
+	HasEnd bool
+	FrameDuration int64
+	Written bool
+}
+
+// toTimescale converts a 90 kHz timestamp to the timescale of the track.
+func (t *remuxTrack) toTimescale(ts int64) int64 {
+	if t.Track.Timescale == 90000 {
+		return ts
+	}
+	return int64(math.Round(float64(ts) * float64(t.Track.Timescale) / 90000))
+}
+
+func (t *remuxTrack) to90kHz(ts int64) int64 {
+	return ts * 90000 / int64(t.Track.Timescale)
+}
+
+// add appends a sample unless it overlaps with the samples before it.
+func (t *remuxTrack) add(sample remuxSample) bool {
+	if t.HasEnd && sample.DTS < t.End - t.FrameDuration / 2 {
+		return false
+	}
+	if t.HasEnd && t.Track.Handler == "vide" && len(t.Pending) > 0 {
+		if delta := sample.DTS - t.Pending[len(t.Pending) - 1].DTS; delta > 0 {
+			t.FrameDuration = delta
+		}
+	}
+	t.Pending = append(t.Pending, sample)
+	t.End = sample.DTS + t.FrameDuration
+	t.HasEnd = true
+	return true
+}
+
+// samples returns the pending samples with their durations. The last sample
+// lasts until next, or one frame if next is negative.
+func (t *remuxTrack) samples(next int64) []mp4.Sample {
+	var samples []mp4.Sample
+	for i, pending := range t.Pending {
+		duration := t.FrameDuration
+		if i + 1 < len(t.Pending) {
+			duration = t.Pending[i + 1].DTS - pending.DTS
+		} else if next > pending.DTS {
+			duration = next - pending.DTS
+		}
+		samples = append(samples, mp4.Sample {
+			Duration: uint32(duration),
+			CompositionOffset: int32(pending.PTS - pending.DTS),
+			Sync: pending.Sync,
+		})
+	}
+	return samples
+}
+
+// remuxOutput receives the samples of a segment once their durations are
+// known.
+type remuxOutput interface {
+	write(tracks []*remuxTrack, next map[*remuxTrack]int64) error
+	close() error
+}
+
+// progressiveOutput writes a single MP4 file with the sample tables at the end.
+type progressiveOutput struct {
+	File *os.File
+	Writer *mp4.Writer
+}
+
+func (o *progressiveOutput) write(tracks []*remuxTrack, next map[*remuxTrack]int64) error {
+	for _, track := range tracks {
+		if len(track.Pending) == 0 {
+			continue
+		}
+		if !track.Written {
+			o.Writer.AddTrack(track.Track)
+			track.Track.StartTime = track.Pending[0].DTS
+			track.Written = true
+		}
+		for i, sample := range track.samples(next[track]) {
+			err := o.Writer.WriteSample(track.Track, sample, track.Pending[i].Data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (o *progressiveOutput) close() error {
+	err := o.Writer.Close()
+	if err != nil {
+		o.File.Close()
+		return err
+	}
+	return o.File.Close()
+}
+
+// fragmentedOutput writes one movie fragment per segment. Tracks may first
+// appear after the first segment, so the fragments are written to Fragments
+// and copied after the initialization segment on close.
+type fragmentedOutput struct {
+	File *os.File
+	Fragments *os.File
+	Tracks []*mp4.Track
+	Sequence uint32
+}
+
+func newFragmentedOutput(file *os.File) (*fragmentedOutput, error) {
+	fragments, err := os.Create(file.Name() + ".part")
+	if err != nil {
+		return nil, err
+	}
+	return &fragmentedOutput{File: file, Fragments: fragments}, nil
+}
+
+func (o *fragmentedOutput) write(tracks []*remuxTrack, next map[*remuxTrack]int64) error {
+	var fragments []mp4.Fragment
+	for _, track := range tracks {
+		if len(track.Pending) == 0 {
+			continue
+		}
+		if !track.Written {
+			track.Track.ID = uint32(len(o.Tracks) + 1)
+			track.Written = true
+			o.Tracks = append(o.Tracks, track.Track)
+		}
+		fragment := mp4.Fragment {
+			Track: track.Track,
+			BaseTime: track.Pending[0].DTS,
+			Samples: track.samples(next[track]),
+		}
+		for _, sample := range track.Pending {
+			fragment.Data = append(fragment.Data, sample.Data)
+		}
+		fragments = append(fragments, fragment)
+	}
+	if len(fragments) == 0 {
+		return nil
+	}
+	o.Sequence++
+	return mp4.WriteFragment(o.Fragments, o.Sequence, fragments)
+}
+
+func (o *fragmentedOutput) close() error {
+	defer os.Remove(o.Fragments.Name())
+	defer o.Fragments.Close()
+	err := mp4.WriteInit(o.File, o.Tracks)
+	if err == nil {
+		_, err = o.Fragments.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		_, err = io.Copy(o.File, o.Fragments)
+	}
+	if err != nil {
+		o.File.Close()
+		return err
+	}
+	return o.File.Close()
+}
+
+// remuxer turns the MPEG-TS segments of a rendition into MP4 samples. Only
+// the first video and audio stream are kept. Timestamps are unwrapped, and
+// after a discontinuity they are shifted to continue where the previous
+// segment ended.
+type remuxer struct {
+	Video *remuxTrack
+	Audio *remuxTrack
+	Output remuxOutput
+	Offset int64
+	Reference int64
+	Started bool
+	Dropped int
+}
+
+func (m *remuxer) tracks() []*remuxTrack {
+	var tracks []*remuxTrack
+	if m.Video != nil {
+		tracks = append(tracks, m.Video)
+	}
+	if m.Audio != nil {
+		tracks = append(tracks, m.Audio)
+	}
+	return tracks
+}
+
+// unwrap returns the timestamp closest to the previous one.
+func (m *remuxer) unwrap(ts int64) int64 {
+	k := int64(math.Round(float64(m.Reference - ts) / float64(timestampWrap)))
+	m.Reference = ts + k * timestampWrap
+	return m.Reference
+}
+
+func lengthPrefixed(nals [][]byte) []byte {
+	var b []byte
+	for _, nal := range nals {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(nal)))
+		b = append(b, nal...)
+	}
+	return b
+}
+
+// newVideoTrack creates the video track from the parameter sets of an access
+// unit, or returns nil if they are incomplete.
+func newVideoTrack(streamType uint8, nals [][]byte) (*remuxTrack, error) {
+	var vps, sps, pps [][]byte
+	for _, nal := range nals {
+		if len(nal) == 0 {
+			continue
+		}
+		if streamType == mpegts.StreamTypeH264 {
+			switch mpegts.H264NALType(nal) {
+			case mpegts.H264NALSPS:
+				sps = append(sps, nal)
+			case mpegts.H264NALPPS:
+				pps = append(pps, nal)
+			}
+			continue
+		}
+		switch mpegts.H265NALType(nal) {
+		case mpegts.H265NALVPS:
+			vps = append(vps, nal)
+		case mpegts.H265NALSPS:
+			sps = append(sps, nal)
+		case mpegts.H265NALPPS:
+			pps = append(pps, nal)
+		}
+	}
+	if len(sps) == 0 || len(pps) == 0 || (streamType == mpegts.StreamTypeH265 && len(vps) == 0) {
+		return nil, nil
+	}
+	track := &remuxTrack {
+		Track: &mp4.Track {
+			Handler: "vide",
+			Timescale: 90000,
+		},
+		StreamType: streamType,
+		ParameterSets: make(map[string]bool),
+		FrameDuration: 3000,
+	}
+	for _, nal := range append(append(vps, sps...), pps...) {
+		track.ParameterSets[string(nal)] = true
+	}
+	if streamType == mpegts.StreamTypeH264 {
+		info, err := mpegts.ParseH264SPS(sps[0])
+		if err != nil {
+			return nil, err
+		}
+		track.Track.Width = info.Width
+		track.Track.Height = info.Height
+		track.Track.SampleEntry = mp4.AVCSampleEntry(info.Width, info.Height, sps, pps,
+			info.ChromaFormat, info.BitDepthLuma, info.BitDepthChroma)
+		return track, nil
+	}
+	info, err := mpegts.ParseH265SPS(sps[0])
+	if err != nil {
+		return nil, err
+	}
+	track.Track.Width = info.Width
+	track.Track.Height = info.Height
+	track.Track.SampleEntry = mp4.HEVCSampleEntry(info.Width, info.Height, vps, sps, pps,
+		info.ProfileTierLevel, info.ChromaFormat, info.BitDepthLuma, info.BitDepthChroma,
+		info.MaxSubLayers, info.TemporalIdNesting)
+	return track, nil
+}
+
+func newAudioTrack(streamType uint8, frame mpegts.AudioFrame) *remuxTrack {
+	track := &remuxTrack {
+		Track: &mp4.Track {
+			Handler: "soun",
+			Timescale: uint32(frame.SampleRate),
+		},
+		StreamType: streamType,
+		FrameDuration: int64(frame.Samples),
+	}
+	if streamType == mpegts.StreamTypeAAC {
+		track.Track.SampleEntry = mp4.AACSampleEntry(frame.Channels, frame.SampleRate,
+			frame.AudioSpecificConfig())
+	} else {
+		track.Track.SampleEntry = mp4.AC3SampleEntry(frame.Channels, frame.SampleRate,
+			frame.AC3Config)
+	}
+	return track
+}
+
+func (m *remuxer) addVideo(pes *mpegts.PES, dts, pts int64) error {
+	nals := mpegts.SplitNALUnits(pes.Data)
+	if m.Video == nil {
+		track, err := newVideoTrack(pes.StreamType, nals)
+		if err != nil || track == nil {
+			return err
+		}
+		m.Video = track
+	}
+	track := m.Video
+	if pes.StreamType != track.StreamType {
+		return fmt.Errorf("video codec changed from stream type %#x to %#x", track.StreamType, pes.StreamType)
+	}
+	var kept [][]byte
+	sync := false
+	for _, nal := range nals {
+		if len(nal) == 0 {
+			continue
+		}
+		if track.StreamType == mpegts.StreamTypeH264 {
+			switch mpegts.H264NALType(nal) {
+			case mpegts.H264NALAUD:
+				continue
+			case mpegts.H264NALIDR:
+				sync = true
+			}
+		} else {
+			nalType := mpegts.H265NALType(nal)
+			if nalType == mpegts.H265NALAUD {
+				continue
+			}
+			if mpegts.H265IsIRAP(nalType) {
+				sync = true
+			}
+		}
+		if track.ParameterSets[string(nal)] {
+			continue
+		}
+		kept = append(kept, nal)
+	}
+	if len(kept) == 0 || (!track.HasEnd && !sync) {
+		return nil
+	}
+	if !track.add(remuxSample{dts, pts, sync, lengthPrefixed(kept)}) {
+		m.Dropped++
+	}
+	return nil
+}
+
+func (m *remuxer) addAudio(pes *mpegts.PES, pts int64) error {
+	var frames []mpegts.AudioFrame
+	var err error
+	if pes.StreamType == mpegts.StreamTypeAAC {
+		frames, err = mpegts.ParseADTS(pes.Data)
+	} else {
+		frames, err = mpegts.ParseAC3(pes.Data)
+	}
+	if len(frames) == 0 {
+		return err
+	}
+	if m.Audio == nil {
+		m.Audio = newAudioTrack(pes.StreamType, frames[0])
+	}
+	track := m.Audio
+	if pes.StreamType != track.StreamType {
+		return fmt.Errorf("audio codec changed from stream type %#x to %#x", track.StreamType, pes.StreamType)
+	}
+	t := track.toTimescale(pts)
+	// Rounding would otherwise leave gaps or overlaps of a sample between
+	// PES packets.
+	if track.HasEnd && t > track.End - track.FrameDuration / 2 && t < track.End + track.FrameDuration / 2 {
+		t = track.End
+	}
+	for _, frame := range frames {
+		if int(track.Track.Timescale) != frame.SampleRate {
+			return fmt.Errorf("audio sample rate changed from %d to %d", track.Track.Timescale, frame.SampleRate)
+		}
+		track.FrameDuration = int64(frame.Samples)
+		if !track.add(remuxSample{t, t, true, frame.Data}) {
+			m.Dropped++
+		}
+		t += int64(frame.Samples)
+	}
+	return err
+}
+
+// addSegment demuxes a segment and writes the samples of the previous one.
+func (m *remuxer) addSegment(data []byte, discontinuity bool) error {
+	streams, packets, err := mpegts.Demux(data)
+	if err != nil && len(packets) == 0 {
+		return err
+	}
+	var video, audio uint16
+	for _, stream := range streams {
+		switch stream.Type {
+		case mpegts.StreamTypeH264, mpegts.StreamTypeH265:
+			if video == 0 {
+				video = stream.PID
+			}
+		case mpegts.StreamTypeAAC, mpegts.StreamTypeAC3:
+			if audio == 0 {
+				audio = stream.PID
+			}
+		}
+	}
+
+	// Unwrap all timestamps first to find where the segment starts.
+	type timestamps struct {
+		DTS int64
+		PTS int64
+	}
+	var times []timestamps
+	first := int64(math.MaxInt64)
+	reset := !m.Started || discontinuity
+	for _, pes := range packets {
+		if !pes.HasPTS {
+			times = append(times, timestamps{})
+			continue
+		}
+		if reset {
+			m.Reference = pes.DTS
+			reset = false
+		}
+		dts := m.unwrap(pes.DTS)
+		pts := dts + (pes.PTS - pes.DTS + timestampWrap) % timestampWrap
+		times = append(times, timestamps{dts, pts})
+		if dts < first {
+			first = dts
+		}
+	}
+	if first == math.MaxInt64 {
+		return err
+	}
+	if !m.Started {
+		m.Offset = -first
+		m.Started = true
+	} else if discontinuity {
+		end := int64(0)
+		for _, track := range m.tracks() {
+			if e := track.to90kHz(track.End); e > end {
+				end = e
+			}
+		}
+		m.Offset = end - first
+	}
+
+	previous := make(map[*remuxTrack][]remuxSample)
+	for _, track := range m.tracks() {
+		previous[track] = track.Pending
+		track.Pending = nil
+	}
+	for i, pes := range packets {
+		if !pes.HasPTS {
+			continue
+		}
+		dts := times[i].DTS + m.Offset
+		pts := times[i].PTS + m.Offset
+		var addErr error
+		if pes.PID == video {
+			addErr = m.addVideo(pes, dts, pts)
+		} else if pes.PID == audio {
+			addErr = m.addAudio(pes, pts)
+		}
+		if addErr != nil && err == nil {
+			err = addErr
+		}
+	}
+
+	// The samples of the previous segment last until the first sample of
+	// this one.
+	next := make(map[*remuxTrack]int64)
+	current := make(map[*remuxTrack][]remuxSample)
+	for _, track := range m.tracks() {
+		next[track] = -1
+		if len(track.Pending) > 0 {
+			next[track] = track.Pending[0].DTS
+		}
+		current[track] = track.Pending
+		track.Pending = previous[track]
+	}
+	writeErr := m.Output.write(m.tracks(), next)
+	for _, track := range m.tracks() {
+		track.Pending = current[track]
+	}
+	if writeErr != nil {
+		return &outputError{writeErr}
+	}
+	return err
+}
+
+// outputError is an error writing the output file, after which remuxing can
+// not go on.
+type outputError struct {
+	Err error
+}
+
+func (e *outputError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *outputError) Unwrap() error {
+	return e.Err
+}
+
+func (m *remuxer) close() error {
+	next := make(map[*remuxTrack]int64)
+	for _, track := range m.tracks() {
+		next[track] = -1
+	}
+	err := m.Output.write(m.tracks(), next)
+	if err != nil {
+		m.Output.close()
+		return err
+	}
+	return m.Output.close()
+}
+
+// remuxRendition writes the MPEG-TS segments of a rendition to a single MP4
+// file.
+func remuxRendition(r *rendition, outputDir string, fragmented bool) error {
+	segments := r.sortedSegments()
+	if len(segments) == 0 {
+		return nil
+	}
+	for _, segment := range segments {
+		if segment.Segment.Map != nil {
+			return fmt.Errorf("segments are fragmented MP4, only MPEG-TS segments can be remuxed, use --concat to join them")
+		}
+	}
+	file, err := os.Create(outputDir + "/" + r.Name + ".mp4")
+	if err != nil {
+		return err
+	}
+	m := &remuxer{}
+	if fragmented {
+		output, err := newFragmentedOutput(file)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		m.Output = output
+	} else {
+		writer, err := mp4.NewWriter(file)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		m.Output = &progressiveOutput{File: file, Writer: writer}
+	}
+	var previous *renditionSegment
+	err = readSegments(segments, readSegment, func(rs *renditionSegment, data []byte, err error) error {
+		segment := rs.Segment
+		if err != nil {
+			if !quarantine(outputDir, quarantineName(r, segment), rs, err) {
+				fmt.Printf("Failed to decrypt %s: %s\n", segment.URI, err)
+			}
+			return nil
+		}
+		discontinuity := previous != nil && previous.Segment.DiscontinuitySeq != segment.DiscontinuitySeq
+		err = m.addSegment(data, discontinuity)
+		if _, ok := err.(*outputError); ok {
+			return err
+		}
+		if err != nil {
+			log.Printf("Warning: %s: %s", segment.URI, err)
+		}
+		previous = rs
+		return nil
+	})
+	if err != nil {
+		m.Output.close()
+		os.Remove(file.Name())
+		return err
+	}
+	if m.Dropped > 0 {
+		log.Printf("Warning: dropped %d overlapping samples of %s", m.Dropped, r.URI)
+	}
+	if len(m.tracks()) == 0 {
+		m.Output.close()
+		os.Remove(file.Name())
+		return fmt.Errorf("no H.264, H.265, AAC or AC-3 stream found")
+	}
+	return m.close()
+}
@@ -0,0 +1,304 @@
+package cmd
+
+import (
+	"os"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"time"
+	"strings"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"hlsrecorder/request"
+)
+
+// renditionSegment is a segment of a rendition together with the playlist
+// snapshot it was first seen in.
+type renditionSegment struct {
+	Playlist *request.Playlist
+	Segment request.Segment
+	Hash string
+}
+
+// segmentKey identifies a segment within a rendition. Media sequence numbers
+// may restart after a discontinuity.
+type segmentKey struct {
+	DiscontinuitySeq uint64 `json:"discontinuity_seq"`
+	SeqId uint64 `json:"seq"`
+}
+
+// segmentConflict is reported when the same segment of a rendition was
+// captured with different bodies.
+type segmentConflict struct {
+	Rendition string `json:"rendition"`
+	DiscontinuitySeq uint64 `json:"discontinuity_seq"`
+	SeqId uint64 `json:"seq"`
+	URI string `json:"uri"`
+	Hash string `json:"hash"`
+	ConflictingURI string `json:"conflicting_uri"`
+	ConflictingHash string `json:"conflicting_hash"`
+}
+
+// rendition collects the segments of one media playlist over all of its
+// snapshots.
+type rendition struct {
+	URI string
+	Name string
+	Segments map[segmentKey]*renditionSegment
+	Conflicts []segmentConflict
+	// Referenced holds all segments referenced by a snapshot, captured or
+	// not.
+	Referenced map[segmentKey]request.Segment
+	SnapshotTimes []int64
+	TargetDuration float64
+}
+
+// sortedSegments returns the segments in media sequence order.
+func (r *rendition) sortedSegments() []*renditionSegment {
+	var segments []*renditionSegment
+	for _, segment := range r.Segments {
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		a := segments[i].Segment
+		b := segments[j].Segment
+		if a.DiscontinuitySeq != b.DiscontinuitySeq {
+			return a.DiscontinuitySeq < b.DiscontinuitySeq
+		}
+		return a.SeqId < b.SeqId
+	})
+	return segments
+}
+
+// hashCache holds segment hashes by body and byte range, as most segments
+// appear in several snapshots.
+type hashCache struct {
+	Mutex sync.Mutex
+	Hashes map[string]string
+}
+
+// segmentHash returns the hash of the stored body of a segment.
+func segmentHash(playlist *request.Playlist, segment request.Segment, cache *hashCache) string {
+	cacheKey := fmt.Sprintf("%d:%d:%d", segment.Index, segment.Offset, segment.Limit)
+	cache.Mutex.Lock()
+	hash, ok := cache.Hashes[cacheKey]
+	cache.Mutex.Unlock()
+	if ok {
+		return hash
+	}
+	data := playlist.Database.ReadBody(segment.Index)
+	if segment.Limit > 0 && segment.Offset + segment.Limit <= int64(len(data)) {
+		data = data[segment.Offset:segment.Offset + segment.Limit]
+	}
+	sum := sha256.Sum256(data)
+	hash = hex.EncodeToString(sum[:])
+	cache.Mutex.Lock()
+	cache.Hashes[cacheKey] = hash
+	cache.Mutex.Unlock()
+	return hash
+}
+
+// snapshot is a parsed playlist snapshot with the hashes of its captured
+// segments.
+type snapshot struct {
+	Playlist *request.Playlist
+	Segments []request.Segment
+	Hashes []string
+	Err error
+}
+
+// collector merges playlist snapshots into renditions. It can be called
+// again as the database grows.
+type collector struct {
+	Database *request.RequestDatabase
+	Renditions []*rendition
+	Cache *hashCache
+	ByURI map[string]*rendition
+	Names map[string]bool
+	// Next is the first request not searched for playlists yet.
+	Next int
+	// Retry holds snapshots that referenced segments not captured yet.
+	Retry []int
+	Seen map[int]bool
+}
+
+func newCollector(database *request.RequestDatabase) *collector {
+	return &collector {
+		Database: database,
+		Cache: &hashCache{Hashes: make(map[string]string)},
+		ByURI: make(map[string]*rendition),
+		Names: make(map[string]bool),
+		Seen: make(map[int]bool),
+	}
+}
+
+// collectRenditions walks all playlist snapshots of the database.
+func collectRenditions(database *request.RequestDatabase) []*rendition {
+	c := newCollector(database)
+	c.collect(0)
+	return c.Renditions
+}
+
+// collect merges the snapshots captured since the last call. Segments are
+// identified by their sequence numbers, and the first captured body is kept if
+// a segment was captured more than once. Snapshots are parsed and hashed in
+// parallel, but merged in capture order.
+//
+// Snapshots that reference segments which are not captured yet are loaded
+// again by later calls, until they are older than retry.
+func (c *collector) collect(retry time.Duration) {
+	database := c.Database
+	indices := c.Retry
+	c.Retry = nil
+	for idx := c.Next; ; idx++ {
+		idx = database.FindRequest(idx, ".*\\.m3u8(\\?.*)?$")
+		if idx == -1 {
+			break
+		}
+		indices = append(indices, idx)
+	}
+	c.Next = len(database.Requests)
+	latest := int64(0)
+	if len(database.Requests) > 0 {
+		latest = database.Requests[len(database.Requests) - 1].Time
+	}
+
+	pipeline(len(indices), jobs, func(i int) interface{} {
+		playlist, _, err := request.LoadPartialPlaylist(database, indices[i], false, -1)
+		if err != nil {
+			return snapshot{Err: err}
+		}
+		s := snapshot {
+			Playlist: playlist,
+			Segments: playlist.Segments(),
+		}
+		for _, segment := range s.Segments {
+			hash := ""
+			if segment.Index != -1 {
+				hash = segmentHash(playlist, segment, c.Cache)
+			}
+			s.Hashes = append(s.Hashes, hash)
+		}
+		return s
+	}, func(i int, value interface{}) error {
+		s := value.(snapshot)
+		seen := c.Seen[indices[i]]
+		c.Seen[indices[i]] = true
+		if s.Err != nil {
+			if !seen {
+				fmt.Printf("failed to load playlist: %s\n", s.Err);
+			}
+			return nil
+		}
+		playlist := s.Playlist
+		warnUnsupportedKeys(playlist)
+		uri := playlist.Rendition()
+		r, ok := c.ByURI[uri]
+		if !ok {
+			r = &rendition {
+				URI: uri,
+				Name: uniqueName(renditionName(uri), c.Names),
+				Segments: make(map[segmentKey]*renditionSegment),
+				Referenced: make(map[segmentKey]request.Segment),
+			}
+			c.ByURI[uri] = r
+			c.Renditions = append(c.Renditions, r)
+		}
+		if !seen {
+			r.SnapshotTimes = append(r.SnapshotTimes, playlist.Time())
+		}
+		if playlist.M3U8Playlist.TargetDuration > r.TargetDuration {
+			r.TargetDuration = playlist.M3U8Playlist.TargetDuration
+		}
+		incomplete := false
+		for j, segment := range s.Segments {
+			key := segmentKey{segment.DiscontinuitySeq, segment.SeqId}
+			if _, ok := r.Referenced[key]; !ok {
+				r.Referenced[key] = segment
+			}
+			if segment.Index == -1 {
+				incomplete = true
+				continue
+			}
+			hash := s.Hashes[j]
+			if existing, ok := r.Segments[key]; ok {
+				if existing.Hash != hash {
+					r.addConflict(existing, segment, hash)
+				}
+				continue
+			}
+			r.Segments[key] = &renditionSegment {
+				Playlist: playlist,
+				Segment: segment,
+				Hash: hash,
+			}
+		}
+		age := time.Duration(latest - playlist.Time()) * time.Microsecond
+		if incomplete && age < retry {
+			c.Retry = append(c.Retry, indices[i])
+		}
+		return nil
+	})
+}
+
+func (r *rendition) addConflict(existing *renditionSegment, segment request.Segment, hash string) {
+	for _, conflict := range r.Conflicts {
+		if conflict.DiscontinuitySeq == segment.DiscontinuitySeq &&
+				conflict.SeqId == segment.SeqId && conflict.ConflictingHash == hash {
+			return
+		}
+	}
+	requests := existing.Playlist.Database.Requests
+	r.Conflicts = append(r.Conflicts, segmentConflict {
+		Rendition: r.URI,
+		DiscontinuitySeq: segment.DiscontinuitySeq,
+		SeqId: segment.SeqId,
+		URI: requests[existing.Segment.Index].URI,
+		Hash: existing.Hash,
+		ConflictingURI: requests[segment.Index].URI,
+		ConflictingHash: hash,
+	})
+}
+
+// reportConflicts prints the conflicts of all renditions and writes them to
+// conflicts.json in the output directory.
+func reportConflicts(renditions []*rendition, outputDir string) error {
+	var conflicts []segmentConflict
+	for _, r := range renditions {
+		for _, conflict := range r.Conflicts {
+			fmt.Printf("Conflict in %s: segment %d (discontinuity %d) is %s (%s) and %s (%s)\n",
+				conflict.Rendition, conflict.SeqId, conflict.DiscontinuitySeq,
+				conflict.URI, conflict.Hash[:12], conflict.ConflictingURI, conflict.ConflictingHash[:12])
+			conflicts = append(conflicts, conflict)
+		}
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(conflicts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(outputDir + "/conflicts.json", data, 0644)
+}
+
+func renditionName(uri string) string {
+	name := path.Base(uri)
+	name = strings.TrimSuffix(name, path.Ext(name))
+	if name == "" || name == "." || name == "/" {
+		name = "rendition"
+	}
+	return sanitizeName(name)
+}
+
+func uniqueName(name string, names map[string]bool) string {
+	unique := name
+	for i := 2; names[unique]; i++ {
+		unique = fmt.Sprintf("%s_%d", name, i)
+	}
+	names[unique] = true
+	return unique
+}
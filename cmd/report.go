@@ -0,0 +1,215 @@
+package cmd
+
+import (
+	"io"
+	"os"
+	"log"
+	"fmt"
+	"sort"
+	"time"
+	"encoding/json"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"hlsrecorder/request"
+)
+
+type sequenceRange struct {
+	DiscontinuitySeq uint64 `json:"discontinuity_seq"`
+	From uint64 `json:"from"`
+	To uint64 `json:"to"`
+}
+
+type reportSegment struct {
+	DiscontinuitySeq uint64 `json:"discontinuity_seq"`
+	SeqId uint64 `json:"seq"`
+	URI string `json:"uri"`
+	Error string `json:"error,omitempty"`
+}
+
+type timeRange struct {
+	From time.Time `json:"from"`
+	To time.Time `json:"to"`
+	Seconds float64 `json:"seconds"`
+}
+
+type renditionReport struct {
+	URI string `json:"uri"`
+	Snapshots int `json:"snapshots"`
+	Referenced int `json:"referenced"`
+	Captured int `json:"captured"`
+	MissingSequences []sequenceRange `json:"missing_sequences"`
+	NotCaptured []reportSegment `json:"not_captured"`
+	MissingKeys []string `json:"missing_keys"`
+	FailedDecryptions []reportSegment `json:"failed_decryptions"`
+	RefreshGaps []timeRange `json:"refresh_gaps"`
+}
+
+func sortedKeys(keys map[segmentKey]request.Segment) []segmentKey {
+	var sorted []segmentKey
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].DiscontinuitySeq != sorted[j].DiscontinuitySeq {
+			return sorted[i].DiscontinuitySeq < sorted[j].DiscontinuitySeq
+		}
+		return sorted[i].SeqId < sorted[j].SeqId
+	})
+	return sorted
+}
+
+// reportRendition checks a rendition for holes. A refresh gap is reported if
+// no snapshot was captured for longer than refreshGap, or three target
+// durations if refreshGap is 0.
+func reportRendition(r *rendition, refreshGap time.Duration) renditionReport {
+	report := renditionReport {
+		URI: r.URI,
+		Snapshots: len(r.SnapshotTimes),
+		Referenced: len(r.Referenced),
+		Captured: len(r.Segments),
+	}
+	keys := sortedKeys(r.Referenced)
+	for i, key := range keys {
+		if i > 0 {
+			previous := keys[i - 1]
+			if previous.DiscontinuitySeq == key.DiscontinuitySeq && key.SeqId > previous.SeqId + 1 {
+				report.MissingSequences = append(report.MissingSequences, sequenceRange {
+					DiscontinuitySeq: key.DiscontinuitySeq,
+					From: previous.SeqId + 1,
+					To: key.SeqId - 1,
+				})
+			}
+		}
+		if _, ok := r.Segments[key]; !ok {
+			report.NotCaptured = append(report.NotCaptured, reportSegment {
+				DiscontinuitySeq: key.DiscontinuitySeq,
+				SeqId: key.SeqId,
+				URI: r.Referenced[key].URI,
+			})
+		}
+	}
+
+	missingKeys := make(map[string]bool)
+	for _, rs := range r.sortedSegments() {
+		segment := rs.Segment
+		if segment.Key == nil {
+			continue
+		}
+		if segmentKeyData(rs.Playlist, segment.Key) == nil {
+			if !missingKeys[segment.Key.URI] {
+				missingKeys[segment.Key.URI] = true
+				report.MissingKeys = append(report.MissingKeys, segment.Key.URI)
+			}
+			continue
+		}
+		_, err := readSegment(rs.Playlist, segment)
+		if err != nil {
+			report.FailedDecryptions = append(report.FailedDecryptions, reportSegment {
+				DiscontinuitySeq: segment.DiscontinuitySeq,
+				SeqId: segment.SeqId,
+				URI: segment.URI,
+				Error: err.Error(),
+			})
+		}
+	}
+
+	if refreshGap == 0 {
+		refreshGap = time.Duration(r.TargetDuration * 3 * float64(time.Second))
+	}
+	times := append([]int64(nil), r.SnapshotTimes...)
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	for i := 1; i < len(times); i++ {
+		gap := time.Duration(times[i] - times[i - 1]) * time.Microsecond
+		if refreshGap > 0 && gap > refreshGap {
+			report.RefreshGaps = append(report.RefreshGaps, timeRange {
+				From: time.UnixMicro(times[i - 1]),
+				To: time.UnixMicro(times[i]),
+				Seconds: gap.Seconds(),
+			})
+		}
+	}
+	return report
+}
+
+func printReport(w io.Writer, reports []renditionReport) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RENDITION\tSNAPSHOTS\tREFERENCED\tCAPTURED\tMISSING SEQ\tNOT CAPTURED\tMISSING KEYS\tFAILED DECRYPTION\tREFRESH GAPS")
+	for _, report := range reports {
+		missing := uint64(0)
+		for _, r := range report.MissingSequences {
+			missing += r.To - r.From + 1
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n",
+			report.URI, report.Snapshots, report.Referenced, report.Captured, missing,
+			len(report.NotCaptured), len(report.MissingKeys),
+			len(report.FailedDecryptions), len(report.RefreshGaps))
+	}
+	tw.Flush()
+	for _, report := range reports {
+		for _, r := range report.MissingSequences {
+			fmt.Fprintf(w, "%s: sequences %d-%d (discontinuity %d) never referenced\n",
+				report.URI, r.From, r.To, r.DiscontinuitySeq)
+		}
+		for _, s := range report.NotCaptured {
+			fmt.Fprintf(w, "%s: segment %d (discontinuity %d) %s not captured\n",
+				report.URI, s.SeqId, s.DiscontinuitySeq, s.URI)
+		}
+		for _, key := range report.MissingKeys {
+			fmt.Fprintf(w, "%s: key %s not captured\n", report.URI, key)
+		}
+		for _, s := range report.FailedDecryptions {
+			fmt.Fprintf(w, "%s: segment %d (discontinuity %d) %s failed to decrypt: %s\n",
+				report.URI, s.SeqId, s.DiscontinuitySeq, s.URI, s.Error)
+		}
+		for _, gap := range report.RefreshGaps {
+			fmt.Fprintf(w, "%s: no playlist refresh from %s to %s (%.1fs)\n", report.URI,
+				gap.From.Format(time.RFC3339), gap.To.Format(time.RFC3339), gap.Seconds)
+		}
+	}
+}
+
+func buildReport(renditions []*rendition, refreshGap time.Duration) []renditionReport {
+	var reports []renditionReport
+	for _, r := range renditions {
+		reports = append(reports, reportRendition(r, refreshGap))
+	}
+	return reports
+}
+
+func report(cmd *cobra.Command, args []string) {
+	fileDir, _ = cmd.Flags().GetString("filedir")
+	metadata, _ := cmd.Flags().GetString("metadata")
+	client, _ := cmd.Flags().GetString("client")
+	asJSON, _ := cmd.Flags().GetBool("json")
+	refreshGap, _ := cmd.Flags().GetDuration("refresh-gap")
+
+	database, err := readDatabase(metadata, fileDir, client)
+	if err != nil {
+		log.Fatal(err)
+	}
+	reports := buildReport(collectRenditions(database), refreshGap)
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(reports)
+		return
+	}
+	printReport(os.Stdout, reports)
+}
+
+// reportCmd represents the report command
+var reportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Report gaps and continuity problems of a recording",
+	Run: report,
+}
+
+func init() {
+	rootCmd.AddCommand(reportCmd)
+
+	reportCmd.Flags().String("client", "", "Only report requests of this client address or proxy user")
+	reportCmd.Flags().Bool("json", false, "Output the report as JSON")
+	reportCmd.Flags().Duration("refresh-gap", 0, "Report periods without playlist refresh longer than this (default 3 target durations)")
+}
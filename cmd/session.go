@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"os"
+	"log"
+	"net"
+	"sync"
+	"time"
+	"strings"
+	"net/http"
+	"crypto/subtle"
+	"encoding/json"
+	"encoding/base64"
+
+	"hlsrecorder/request"
+)
+
+// recordingSession is a metadata journal together with the directory that
+// holds the bodies it refers to.
+type recordingSession struct {
+	Mutex sync.Mutex
+	FileDir string
+	File *os.File
+	Encoder *json.Encoder
+}
+
+func openRecordingSession(metadata, fileDir string) (*recordingSession, error) {
+	os.Mkdir(fileDir, 0755)
+	file, err := os.OpenFile(metadata, os.O_APPEND | os.O_WRONLY | os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingSession {
+		FileDir: fileDir,
+		File: file,
+		Encoder: json.NewEncoder(file),
+	}, nil
+}
+
+func (s *recordingSession) save(metadata request.Metadata) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	err := s.Encoder.Encode(metadata)
+	if err != nil {
+		log.Printf("Warning: failed to save metadata of %s: %s", metadata.URI, err)
+	}
+}
+
+var defaultSession *recordingSession
+
+// splitSessions is "client" or "user" if every client or proxy user gets its
+// own session directory below sessionsDir.
+var splitSessions string
+var sessionsDir string
+var sessionsMutex sync.Mutex
+var sessions = make(map[string]*recordingSession)
+
+// sanitizeName returns name with the characters that can't be part of a
+// directory name replaced, or "" if it can't be used as one.
+func sanitizeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' || r == '%' {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "." || name == ".." {
+		return ""
+	}
+	return name
+}
+
+// sessionFor returns the session a request of the given client and user is
+// recorded to.
+func sessionFor(client, user string) *recordingSession {
+	var name string
+	switch splitSessions {
+	case "client":
+		name = client
+	case "user":
+		name = user
+	}
+	if name == "" {
+		return defaultSession
+	}
+	sanitized := sanitizeName(name)
+	if sanitized == "" {
+		log.Printf("Warning: %s can't be used as a session name, recording to the default session", name)
+		return defaultSession
+	}
+	name = sanitized
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	if s, ok := sessions[name]; ok {
+		return s
+	}
+	dir := sessionsDir + "/" + name
+	os.MkdirAll(dir, 0755)
+	s, err := openRecordingSession(dir + "/metadata.json", dir + "/files")
+	if err != nil {
+		log.Printf("Warning: failed to create session %s: %s", name, err)
+		return defaultSession
+	}
+	log.Printf("new session: %s", dir)
+	sessions[name] = s
+	return s
+}
+
+// proxyUsers maps user names to passwords for Proxy-Authorization.
+var proxyUsers = make(map[string]string)
+
+type authorizedConn struct {
+	User string
+	LastSeen time.Time
+}
+
+// Requests inside a CONNECT tunnel do not carry Proxy-Authorization, so the
+// user that opened the tunnel is remembered by the address of the client
+// connection. Every CONNECT replaces the entry of its address, so that a new
+// connection reusing the address of a closed one can't inherit its user.
+var authorizedConnsMutex sync.Mutex
+var authorizedConns = make(map[string]*authorizedConn)
+var authorizedConnsPruned time.Time
+
+func rememberUser(remoteAddr, user string) {
+	authorizedConnsMutex.Lock()
+	defer authorizedConnsMutex.Unlock()
+	now := time.Now()
+	if now.Sub(authorizedConnsPruned) > time.Hour {
+		for addr, conn := range authorizedConns {
+			if now.Sub(conn.LastSeen) > time.Hour {
+				delete(authorizedConns, addr)
+			}
+		}
+		authorizedConnsPruned = now
+	}
+	if user == "" {
+		delete(authorizedConns, remoteAddr)
+		return
+	}
+	authorizedConns[remoteAddr] = &authorizedConn {
+		User: user,
+		LastSeen: now,
+	}
+}
+
+func lookupUser(remoteAddr string) string {
+	authorizedConnsMutex.Lock()
+	defer authorizedConnsMutex.Unlock()
+	conn, ok := authorizedConns[remoteAddr]
+	if !ok {
+		return ""
+	}
+	conn.LastSeen = time.Now()
+	return conn.User
+}
+
+// authorizeUser checks the Proxy-Authorization header of req and returns the
+// authorized user name.
+func authorizeUser(req *http.Request) (string, bool) {
+	proxyAuth := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(proxyAuth, "Basic ") {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(proxyAuth[len("Basic "):])
+	if err != nil {
+		return "", false
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", false
+	}
+	expected, ok := proxyUsers[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(expected), []byte(password)) != 1 {
+		return "", false
+	}
+	return user, true
+}
+
+func clientHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"testing"
+	"net/http/httptest"
+	"encoding/base64"
+)
+
+func TestAuthorizeUser(t *testing.T) {
+	defer func() {
+		proxyUsers = make(map[string]string)
+	}()
+	proxyUsers = map[string]string {"alice": "secret", "bob": ""}
+	tests := []struct {
+		header string
+		user string
+		ok bool
+	} {
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret")), "alice", true},
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secre")), "", false},
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte("alice:")), "", false},
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte("bob:")), "bob", true},
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte("carol:secret")), "", false},
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte("alice")), "", false},
+		{"Bearer secret", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		if test.header != "" {
+			req.Header.Set("Proxy-Authorization", test.header)
+		}
+		user, ok := authorizeUser(req)
+		if user != test.user || ok != test.ok {
+			t.Errorf("%q: got %q, %t, want %q, %t", test.header, user, ok, test.user, test.ok)
+		}
+	}
+}
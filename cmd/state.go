@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"os"
+	"fmt"
+	"encoding/json"
+)
+
+const dumpStateFile = "dump-state.json"
+
+// concatState is where the concatenated output of a rendition can be
+// continued.
+type concatState struct {
+	Part int `json:"part"`
+	// Open is the file the next segment is appended to if it continues its
+	// discontinuity and init section.
+	Open string `json:"open,omitempty"`
+	DiscontinuitySeq uint64 `json:"discontinuity_seq"`
+	Init string `json:"init,omitempty"`
+	// Last is the segment at the end of Open. Written holds every segment
+	// written so far as "discontinuity/seq", so that segments captured late
+	// are written by a later run as well.
+	Last *segmentKey `json:"last,omitempty"`
+	Written map[string]bool `json:"written,omitempty"`
+}
+
+type renditionState struct {
+	// Written maps "discontinuity/seq" to the file a segment was written to.
+	Written map[string]string `json:"written,omitempty"`
+	Concat *concatState `json:"concat,omitempty"`
+	// Quarantined segments are not retried until the next run, which may be
+	// given other keys.
+	Quarantined map[string]bool `json:"-"`
+}
+
+// dumpState records what earlier dump runs wrote to an output directory, so
+// that later runs only handle new segments.
+type dumpState struct {
+	Format string `json:"format"`
+	Files map[string]bool `json:"files"`
+	Renditions map[string]*renditionState `json:"renditions"`
+}
+
+func (k segmentKey) String() string {
+	return fmt.Sprintf("%d/%d", k.DiscontinuitySeq, k.SeqId)
+}
+
+func (k segmentKey) after(other segmentKey) bool {
+	if k.DiscontinuitySeq != other.DiscontinuitySeq {
+		return k.DiscontinuitySeq > other.DiscontinuitySeq
+	}
+	return k.SeqId > other.SeqId
+}
+
+// loadDumpState reads the state of an output directory. format tells the kind
+// of output, which must not change between runs.
+func loadDumpState(outputDir, format string) (*dumpState, error) {
+	state := &dumpState {
+		Format: format,
+		Files: make(map[string]bool),
+		Renditions: make(map[string]*renditionState),
+	}
+	data, err := os.ReadFile(outputDir + "/" + dumpStateFile)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", dumpStateFile, err)
+	}
+	if state.Format != format {
+		return nil, fmt.Errorf("%s already holds a %s dump", outputDir, state.Format)
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]bool)
+	}
+	if state.Renditions == nil {
+		state.Renditions = make(map[string]*renditionState)
+	}
+	return state, nil
+}
+
+func (s *dumpState) rendition(uri string) *renditionState {
+	r, ok := s.Renditions[uri]
+	if !ok {
+		r = &renditionState {
+			Written: make(map[string]string),
+		}
+		s.Renditions[uri] = r
+	}
+	if r.Written == nil {
+		r.Written = make(map[string]string)
+	}
+	if r.Quarantined == nil {
+		r.Quarantined = make(map[string]bool)
+	}
+	return r
+}
+
+// save replaces the state file, so that an interrupted run leaves the previous
+// state.
+func (s *dumpState) save(outputDir string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	filename := outputDir + "/" + dumpStateFile
+	err = os.WriteFile(filename + ".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(filename + ".tmp", filename)
+}
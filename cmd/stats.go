@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"os"
+	"log"
+	"fmt"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"hlsrecorder/request"
+)
+
+type hostStats struct {
+	Requests int
+	Bytes int64
+	TTFB []int64
+	Throughput []float64
+	Delay []int64
+}
+
+func percentile(values []int64, p float64) int64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]int64(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(float64(len(sorted) - 1) * p)]
+}
+
+func average(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+func stats(cmd *cobra.Command, args []string) {
+	fileDir, _ = cmd.Flags().GetString("filedir")
+	metadata, _ := cmd.Flags().GetString("metadata")
+
+	database, err := request.ReadMetadata(metadata, fileDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The first playlist snapshot referencing a segment tells when it became
+	// visible to clients.
+	firstSeen := make(map[int]int64)
+	idx := 0
+	for {
+		var playlist *request.Playlist
+		var err error
+		playlist, idx, err = request.LoadPlaylist(database, idx, false, -1)
+		if idx == -1 {
+			break
+		}
+		idx++
+		if err != nil {
+			continue
+		}
+		seen := database.Requests[playlist.Index].Time
+		for _, segment := range playlist.M3U8Playlist.Segments {
+			if segment == nil {
+				continue
+			}
+			segmentIdx, ok := playlist.Files[segment.URI]
+			if !ok {
+				continue
+			}
+			if t, ok := firstSeen[segmentIdx]; !ok || seen < t {
+				firstSeen[segmentIdx] = seen
+			}
+		}
+	}
+
+	hosts := make(map[string]*hostStats)
+	var hostNames []string
+	for i, r := range database.Requests {
+		s, ok := hosts[r.Host]
+		if !ok {
+			s = &hostStats{}
+			hosts[r.Host] = s
+			hostNames = append(hostNames, r.Host)
+		}
+		s.Requests++
+		s.Bytes += r.Size
+		if r.StartTime == 0 {
+			continue
+		}
+		if r.FirstByteTime != 0 {
+			s.TTFB = append(s.TTFB, r.FirstByteTime - r.StartTime)
+		}
+		seen, isSegment := firstSeen[i]
+		if !isSegment {
+			continue
+		}
+		duration := r.Time - r.StartTime
+		if duration > 0 {
+			s.Throughput = append(s.Throughput, float64(r.Size) * 8 / float64(duration))
+		}
+		s.Delay = append(s.Delay, r.Time - seen)
+	}
+	sort.Strings(hostNames)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tREQUESTS\tBYTES\tTTFB P50\tTTFB P95\tSEGMENTS\tMBIT/S\tAVAILABLE P50\tAVAILABLE P95")
+	for _, host := range hostNames {
+		s := hosts[host]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%dms\t%dms\t%d\t%.2f\t%dms\t%dms\n",
+			host, s.Requests, s.Bytes,
+			percentile(s.TTFB, 0.5) / 1000, percentile(s.TTFB, 0.95) / 1000,
+			len(s.Throughput), average(s.Throughput),
+			percentile(s.Delay, 0.5) / 1000, percentile(s.Delay, 0.95) / 1000)
+	}
+	w.Flush()
+}
+
+// statsCmd represents the stats command
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show transfer statistics of a recording",
+	Long: `Show per-host transfer statistics of a recording.
+
+TTFB is the time from sending a request to receiving the first byte of the
+response. MBIT/S is the average throughput of segment downloads. AVAILABLE is
+the time from the first playlist referencing a segment until the segment has
+been downloaded completely.`,
+	Run: stats,
+}
+
+func init() {
+	rootCmd.AddCommand(statsCmd)
+}
@@ -0,0 +1,291 @@
+package cmd
+
+import (
+	"io"
+	"os"
+	"log"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"bytes"
+	"strings"
+	"net/url"
+	"net/http"
+	"encoding/json"
+	"text/tabwriter"
+
+	"github.com/grafov/m3u8"
+
+	"hlsrecorder/request"
+)
+
+// maxPlaylistSize limits the size of bodies inspected for playlists.
+const maxPlaylistSize = 4 << 20
+
+// detectedStream describes a playlist seen by record.
+type detectedStream struct {
+	URI string `json:"uri"`
+	Type string `json:"type"`
+	Client string `json:"client,omitempty"`
+	User string `json:"user,omitempty"`
+	Variants []string `json:"variants,omitempty"`
+	Segments int `json:"segments"`
+	SeqNo uint64 `json:"seq_no"`
+	Encrypted bool `json:"encrypted"`
+	Ended bool `json:"ended"`
+	FirstSeen int64 `json:"first_seen"`
+	LastUpdate int64 `json:"last_update"`
+	Updates int `json:"updates"`
+	Handoff *streamHandoff `json:"-"`
+}
+
+type streamTable struct {
+	Mutex sync.Mutex
+	Streams map[string]*detectedStream
+	Changed bool
+	// Token is required by the status endpoints.
+	Token string
+}
+
+var detectedStreams = &streamTable {
+	Streams: make(map[string]*detectedStream),
+}
+
+func isPlaylistResponse(metadata request.Metadata, contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	if strings.Contains(contentType, "mpegurl") {
+		return true
+	}
+	parsedURI, err := url.Parse(metadata.URI)
+	if err != nil {
+		return false
+	}
+	return strings.HasSuffix(parsedURI.Path, ".m3u8") || strings.HasSuffix(parsedURI.Path, ".m3u")
+}
+
+func resolveURI(base, uri string) string {
+	parsedBase, err := url.Parse(base)
+	if err != nil {
+		return uri
+	}
+	parsedURI, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	return parsedBase.ResolveReference(parsedURI).String()
+}
+
+// inspect parses a recorded body and updates the table if it is a playlist.
+func (t *streamTable) inspect(metadata request.Metadata, filename string, header http.Header) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	body, err := io.ReadAll(io.LimitReader(file, maxPlaylistSize))
+	if err != nil || !bytes.HasPrefix(bytes.TrimSpace(body), []byte("#EXTM3U")) {
+		return
+	}
+	p, listType, err := m3u8.Decode(*bytes.NewBuffer(body), false)
+	if err != nil {
+		log.Printf("Warning: failed to parse playlist %s: %s", metadata.URI, err)
+		return
+	}
+	stream := &detectedStream {
+		URI: metadata.URI,
+		Client: metadata.Client,
+		User: metadata.User,
+		Handoff: newStreamHandoff(metadata.URI, header, metadata.Client, metadata.Time),
+	}
+	switch listType {
+	case m3u8.MASTER:
+		stream.Type = "master"
+		for _, variant := range p.(*m3u8.MasterPlaylist).Variants {
+			if variant != nil {
+				stream.Variants = append(stream.Variants, resolveURI(metadata.URI, variant.URI))
+			}
+		}
+	case m3u8.MEDIA:
+		mediaPlaylist := p.(*m3u8.MediaPlaylist)
+		stream.Type = "media"
+		stream.SeqNo = mediaPlaylist.SeqNo
+		stream.Ended = mediaPlaylist.Closed
+		stream.Encrypted = mediaPlaylist.Key != nil && mediaPlaylist.Key.Method != "NONE"
+		for _, segment := range mediaPlaylist.Segments {
+			if segment == nil {
+				continue
+			}
+			stream.Segments++
+			if segment.Key != nil && segment.Key.Method != "NONE" {
+				stream.Encrypted = true
+			}
+		}
+	}
+	t.update(stream, metadata.Time)
+	if handoffDir != "" {
+		_, err = saveHandoff(stream.Handoff)
+		if err != nil {
+			log.Printf("Warning: failed to save handoff of %s: %s", metadata.URI, err)
+		}
+	}
+}
+
+// streamKey identifies a stream. Playlists of live streams are usually
+// requested with changing tokens, so streams are told apart without the query.
+func streamKey(uri string) string {
+	if idx := strings.Index(uri, "?"); idx != -1 {
+		return uri[:idx]
+	}
+	return uri
+}
+
+// key identifies a stream watched by a client, so that clients watching the
+// same stream get a row each.
+func (s *detectedStream) key() string {
+	return s.Client + " " + s.User + " " + streamKey(s.URI)
+}
+
+func (t *streamTable) update(stream *detectedStream, timestamp int64) {
+	t.Mutex.Lock()
+	defer t.Mutex.Unlock()
+	key := stream.key()
+	old, ok := t.Streams[key]
+	if !ok {
+		log.Printf("detected %s playlist: %s", stream.Type, stream.URI)
+		stream.FirstSeen = timestamp
+	} else {
+		stream.FirstSeen = old.FirstSeen
+		stream.Updates = old.Updates
+	}
+	stream.LastUpdate = timestamp
+	stream.Updates++
+	t.Streams[key] = stream
+	t.Changed = true
+}
+
+func (t *streamTable) list() []detectedStream {
+	t.Mutex.Lock()
+	defer t.Mutex.Unlock()
+	var streams []detectedStream
+	for _, stream := range t.Streams {
+		streams = append(streams, *stream)
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].FirstSeen < streams[j].FirstSeen
+	})
+	return streams
+}
+
+func (t *streamTable) print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TYPE\tVARIANTS\tSEGMENTS\tSEQ\tENCRYPTED\tENDED\tLAST UPDATE\tCLIENT\tUSER\tURI")
+	for _, stream := range t.list() {
+		lastUpdate := time.UnixMicro(stream.LastUpdate).Format("15:04:05")
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%t\t%t\t%s\t%s\t%s\t%s\n",
+			stream.Type, len(stream.Variants), stream.Segments, stream.SeqNo,
+			stream.Encrypted, stream.Ended, lastUpdate, stream.Client, stream.User, stream.URI)
+	}
+	tw.Flush()
+}
+
+// printStreams prints the table to the console whenever it has changed.
+func (t *streamTable) printStreams(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		t.Mutex.Lock()
+		changed := t.Changed
+		t.Changed = false
+		t.Mutex.Unlock()
+		if changed {
+			t.print(os.Stdout)
+		}
+	}
+}
+
+// findHandoff returns the handoff of the last update of the playlist uri,
+// optionally only of the given client and user.
+func (t *streamTable) findHandoff(uri, client, user string) *streamHandoff {
+	t.Mutex.Lock()
+	defer t.Mutex.Unlock()
+	var found *detectedStream
+	for _, stream := range t.Streams {
+		if streamKey(stream.URI) != streamKey(uri) ||
+				client != "" && stream.Client != client || user != "" && stream.User != user {
+			continue
+		}
+		if found == nil || stream.LastUpdate > found.LastUpdate {
+			found = stream
+		}
+	}
+	if found == nil {
+		return nil
+	}
+	return found.Handoff
+}
+
+func (t *streamTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Stream URIs can carry signed query tokens, so every endpoint requires the
+	// token.
+	if !checkToken(r, t.Token) {
+		http.Error(w, "forbidden", 403)
+		return
+	}
+	switch r.URL.Path {
+	case "/streams.json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t.list())
+		return
+	case "/handoff":
+		query := r.URL.Query()
+		handoff := t.findHandoff(query.Get("uri"), query.Get("client"), query.Get("user"))
+		if handoff == nil {
+			http.Error(w, "stream not found", 404)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(handoff.redacted())
+		return
+	case "/proxy":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", 405)
+			return
+		}
+		if handoffDir == "" {
+			http.Error(w, "record was started without --handoff-dir", 400)
+			return
+		}
+		handoff := t.findHandoff(r.FormValue("uri"), r.FormValue("client"), r.FormValue("user"))
+		if handoff == nil {
+			http.Error(w, "stream not found", 404)
+			return
+		}
+		listen := loopbackAddr(r.FormValue("listen"))
+		if listen == "" {
+			http.Error(w, "listen is required", 400)
+			return
+		}
+		dir, err := startProxyJob(handoff, listen)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		fmt.Fprintf(w, "recording %s to %s, serving on %s\n", handoff.URI, dir, listen)
+		return
+	}
+	if r.URL.Path != "/" {
+		w.WriteHeader(404)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	t.print(w)
+}
+
+// loopbackAddr binds a listen address without a host to the loopback
+// interface instead of all interfaces.
+func loopbackAddr(addr string) string {
+	if strings.HasPrefix(addr, ":") {
+		return "127.0.0.1" + addr
+	}
+	return addr
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"testing"
+	"net/http/httptest"
+)
+
+func TestStreamTableToken(t *testing.T) {
+	table := &streamTable {
+		Streams: map[string]*detectedStream {
+			"live": {URI: "http://example.com/live/index.m3u8?sig=secret", Type: "media"},
+		},
+		Token: "token",
+	}
+	tests := []struct {
+		path string
+		bearer string
+		status int
+	} {
+		{"/", "", 403},
+		{"/streams.json", "", 403},
+		{"/handoff?uri=x", "", 403},
+		{"/?token=wrong", "", 403},
+		{"/?token=token", "", 200},
+		{"/streams.json", "token", 200},
+		{"/handoff?uri=x&token=token", "", 404},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.path, nil)
+		if test.bearer != "" {
+			req.Header.Set("Authorization", "Bearer " + test.bearer)
+		}
+		w := httptest.NewRecorder()
+		table.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.path, w.Code, test.status)
+		}
+	}
+}
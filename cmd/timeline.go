@@ -0,0 +1,319 @@
+package cmd
+
+import (
+	"log"
+	"errors"
+	"sync"
+	"time"
+	"regexp"
+	"strings"
+	"net/http"
+
+	"hlsrecorder/request"
+)
+
+// timeline is the recording play serves from. The shared playlist and all
+// sessions read it, so that snapshots are parsed once and the metadata is
+// only read as it grows.
+type timeline struct {
+	Mutex sync.Mutex
+	Metadata string
+	Client string
+	Follower *request.MetadataFollower
+	Database *request.RequestDatabase
+	// Playlists caches parsed snapshots by request index. Order is the
+	// order they were added in, so that the oldest are evicted first.
+	Playlists map[int]*cachedPlaylist
+	Order []int
+}
+
+// cachedPlaylist is a parsed snapshot. Snapshots that reference files which
+// were not captured yet may change as requests are added, so they are only
+// used as long as the database has Requests requests.
+type cachedPlaylist struct {
+	Playlist *request.Playlist
+	Err error
+	Complete bool
+	Requests int
+}
+
+// Number of parsed snapshots the timeline keeps.
+const maxCachedPlaylists = 256
+
+var recording *timeline
+
+func openTimeline(metadata, fileDir, client string) *timeline {
+	return &timeline {
+		Metadata: metadata,
+		Client: client,
+		Database: request.NewRequestDatabase(fileDir),
+		Playlists: make(map[int]*cachedPlaylist),
+	}
+}
+
+// refresh reads the requests appended to the metadata since the last call.
+func (t *timeline) refresh() {
+	if t.Follower == nil {
+		follower, err := request.FollowMetadata(t.Metadata, t.Client)
+		if err != nil {
+			// The recording may not have started yet.
+			return
+		}
+		t.Follower = follower
+	}
+	_, err := t.Follower.ReadNew(t.Database)
+	if err != nil {
+		log.Printf("Warning: failed to read %s: %s", t.Metadata, err)
+	}
+}
+
+// origin returns the timestamp of the first request.
+func (t *timeline) origin() (int64, bool) {
+	t.Mutex.Lock()
+	defer t.Mutex.Unlock()
+	t.refresh()
+	if len(t.Database.Requests) == 0 {
+		return 0, false
+	}
+	return t.Database.Requests[0].Time, true
+}
+
+// load parses the snapshot of request idx. Snapshots that may still change
+// as the recording goes on, because parts of them were not captured yet, are
+// parsed again once requests were added.
+func (t *timeline) load(idx int) (*request.Playlist, error) {
+	requests := len(t.Database.Requests)
+	cached, ok := t.Playlists[idx]
+	if ok && (cached.Complete || cached.Requests == requests) {
+		return cached.Playlist, cached.Err
+	}
+	playlist, _, err := request.LoadPartialPlaylist(t.Database, idx, true, -1)
+	complete := true
+	if err == nil {
+		localizeKeys(playlist)
+		complete = len(playlist.Missing) == 0
+		for _, part := range playlist.Parts {
+			if part.Index == -1 {
+				complete = false
+			}
+		}
+	}
+	if !ok {
+		if len(t.Order) >= maxCachedPlaylists {
+			delete(t.Playlists, t.Order[0])
+			t.Order = t.Order[1:]
+		}
+		t.Order = append(t.Order, idx)
+	}
+	t.Playlists[idx] = &cachedPlaylist {
+		Playlist: playlist,
+		Err: err,
+		Complete: complete,
+		Requests: requests,
+	}
+	return playlist, err
+}
+
+// playlistAt returns the last playable snapshot captured before timestamp, or
+// the last one if timestamp is -1.
+func (t *timeline) playlistAt(timestamp int64) *request.Playlist {
+	t.Mutex.Lock()
+	defer t.Mutex.Unlock()
+	t.refresh()
+	database := t.Database
+	if len(database.Requests) == 0 {
+		return nil
+	}
+	idx := -1
+	if timestamp != -1 {
+		if timestamp < database.Requests[0].Time {
+			return nil
+		}
+		// -1 if timestamp is after the last request.
+		idx = database.FindTimestamp(0, timestamp)
+	}
+	for {
+		idx = database.FindRequestReverse(idx, ".*\\.m3u8(\\?.*)?$")
+		if idx == -1 {
+			return nil
+		}
+		playlist, err := t.load(idx)
+		// Delta updates can not be served as full playlists.
+		if err == nil && playlist.Skipped == 0 && keysAvailable(playlist) {
+			warnUnsupportedKeys(playlist)
+			return playlist
+		}
+		if idx == 0 {
+			return nil
+		}
+		idx--
+	}
+}
+
+// playSession is a timeline of its own with its own clock, created by
+// requesting /s/{id}/play.m3u8. The clock is nil with --realtime unless the
+// session was started at a given time.
+type playSession struct {
+	Mutex sync.Mutex
+	Clock *playClock
+	Playlist *request.Playlist
+	Seeks int
+	Seeked bool
+	LastSeen time.Time
+}
+
+var playSessions = struct {
+	Mutex sync.Mutex
+	Sessions map[string]*playSession
+} {
+	Sessions: make(map[string]*playSession),
+}
+
+var sessionTimeout time.Duration
+var maxSessions int
+
+var errTooManySessions = errors.New("too many sessions")
+
+var sessionIdPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// findSession returns the session id, creating it at start if it does not
+// exist and create is set.
+func findSession(id, start string, create bool) (*playSession, error) {
+	playSessions.Mutex.Lock()
+	defer playSessions.Mutex.Unlock()
+	session, ok := playSessions.Sessions[id]
+	if ok || !create {
+		return session, nil
+	}
+	if len(playSessions.Sessions) >= maxSessions {
+		return nil, errTooManySessions
+	}
+	session = &playSession {
+		LastSeen: time.Now(),
+	}
+	if start != "" {
+		origin, ok := recording.origin()
+		if ok {
+			t, err := parseTimeArg(start, time.UnixMicro(origin))
+			if err != nil {
+				return nil, err
+			}
+			session.Clock = newPlayClock(0)
+			session.Clock.seek(t.UnixMicro())
+		}
+	} else if playback != nil {
+		// Sessions start where the shared playlist is.
+		position, _ := playback.timestamp()
+		session.Clock = newPlayClock(0)
+		session.Clock.seek(position)
+	}
+	playSessions.Sessions[id] = session
+	return session, nil
+}
+
+// update moves the playlist of the session to the position of its clock.
+func (s *playSession) update() *request.Playlist {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	s.LastSeen = time.Now()
+	var timestamp int64
+	timestamp = -1
+	if s.Clock != nil {
+		var n int
+		timestamp, n = s.Clock.timestamp()
+		if n != s.Seeks {
+			s.Seeks = n
+			s.Seeked = true
+		}
+	}
+	playlist := recording.playlistAt(timestamp)
+	if playlist != nil && (s.Playlist == nil || s.Seeked || playlist.Newer(s.Playlist)) {
+		s.Playlist = playlist
+		s.Seeked = false
+	}
+	return s.Playlist
+}
+
+// sessionSource serves the playlist of a session. Only playlist requests
+// move it forward, files are served from the playlist the player has.
+type sessionSource struct {
+	Session *playSession
+	Update bool
+}
+
+func (s sessionSource) current() *request.Playlist {
+	if s.Update {
+		return s.Session.update()
+	}
+	s.Session.Mutex.Lock()
+	defer s.Session.Mutex.Unlock()
+	s.Session.LastSeen = time.Now()
+	return s.Session.Playlist
+}
+
+func (s sessionSource) wait(playlist *request.Playlist, deadline time.Time) *request.Playlist {
+	for {
+		current := s.Session.update()
+		// Snapshots that are not cached are parsed again, so they are
+		// compared by the request they were loaded from.
+		if current == nil || playlist == nil || current.Index != playlist.Index ||
+				!time.Now().Before(deadline) {
+			return current
+		}
+		interval := pollInterval(current)
+		if s.Session.Clock != nil {
+			interval = s.Session.Clock.interval(interval)
+		}
+		if remaining := time.Until(deadline); interval > remaining {
+			interval = remaining
+		}
+		time.Sleep(interval)
+	}
+}
+
+// sessionHandler serves /s/{id}/play.m3u8, the files of the session and its
+// control API under /s/{id}/_control.
+func sessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, path, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/s/"), "/")
+	path = strings.Trim(path, "/")
+	if !sessionIdPattern.MatchString(id) {
+		http.Error(w, "invalid session id", 400)
+		return
+	}
+	session, err := findSession(id, r.URL.Query().Get("start"), path == "play.m3u8")
+	if err == errTooManySessions {
+		http.Error(w, err.Error(), 503)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if session == nil {
+		http.Error(w, "session not found, request play.m3u8 to start it", 404)
+		return
+	}
+	if path == "_control" || strings.HasPrefix(path, "_control/") {
+		action := strings.Trim(strings.TrimPrefix(path, "_control"), "/")
+		serveControl(w, r, action, session.Clock, sessionSource{session, true})
+		return
+	}
+	serveFile(w, r, path, sessionSource{session, path == "play.m3u8"})
+}
+
+// expireSessions removes the sessions that were not used for timeout.
+func expireSessions(timeout time.Duration) {
+	for {
+		time.Sleep(timeout / 4)
+		playSessions.Mutex.Lock()
+		for id, session := range playSessions.Sessions {
+			session.Mutex.Lock()
+			idle := time.Since(session.LastSeen)
+			session.Mutex.Unlock()
+			if idle > timeout {
+				delete(playSessions.Sessions, id)
+			}
+		}
+		playSessions.Mutex.Unlock()
+	}
+}
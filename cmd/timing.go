@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"sync"
+	"time"
+	"context"
+	"net/http/httptrace"
+
+	"hlsrecorder/request"
+)
+
+// transferTiming collects the timestamps of a single request/response pair.
+type transferTiming struct {
+	Mutex sync.Mutex
+	Start int64
+	FirstByte int64
+	RemoteAddr string
+}
+
+func newTransferTiming() *transferTiming {
+	return &transferTiming {
+		Start: time.Now().UnixMicro(),
+	}
+}
+
+func (t *transferTiming) withTrace(ctx context.Context) context.Context {
+	trace := &httptrace.ClientTrace {
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Conn == nil {
+				return
+			}
+			t.Mutex.Lock()
+			t.RemoteAddr = info.Conn.RemoteAddr().String()
+			t.Mutex.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			t.Mutex.Lock()
+			t.FirstByte = time.Now().UnixMicro()
+			t.Mutex.Unlock()
+		},
+	}
+	return httptrace.WithClientTrace(ctx, trace)
+}
+
+// fill copies the collected timing into metadata. The response headers have
+// been received by the time this is called, so it is used as the time to first
+// byte if the trace did not report one.
+func (t *transferTiming) fill(metadata *request.Metadata, headerTime int64) {
+	t.Mutex.Lock()
+	defer t.Mutex.Unlock()
+	metadata.StartTime = t.Start
+	metadata.FirstByteTime = t.FirstByte
+	if metadata.FirstByteTime == 0 {
+		metadata.FirstByteTime = headerTime
+	}
+	metadata.RemoteAddr = t.RemoteAddr
+}
@@ -0,0 +1,260 @@
+package cmd
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"path"
+	"bytes"
+	"bufio"
+	"errors"
+	"strings"
+	"encoding/binary"
+
+	"hlsrecorder/mpegts"
+	"hlsrecorder/request"
+)
+
+// badSegmentError is returned for segments that do not decrypt to valid
+// media, which usually means that the key is wrong.
+type badSegmentError struct {
+	Err error
+}
+
+func (e *badSegmentError) Error() string {
+	return e.Err.Error()
+}
+
+func badSegment(format string, args ...interface{}) error {
+	return &badSegmentError{fmt.Errorf(format, args...)}
+}
+
+// validateTS checks that every packet starts with a sync byte.
+func validateTS(r *bufio.Reader) error {
+	packet := make([]byte, mpegts.PacketSize)
+	for offset := 0; ; offset += mpegts.PacketSize {
+		_, err := io.ReadFull(r, packet)
+		if err == io.EOF {
+			if offset == 0 {
+				return badSegment("empty segment")
+			}
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return badSegment("truncated TS packet at offset %d", offset)
+		}
+		if err != nil {
+			return err
+		}
+		if packet[0] != 0x47 {
+			return badSegment("no TS sync byte at offset %d", offset)
+		}
+	}
+}
+
+// Boxes that may appear at the top level of an fMP4 media segment.
+var segmentBoxes = map[string]bool {
+	"styp": true,
+	"sidx": true,
+	"ssix": true,
+	"prft": true,
+	"emsg": true,
+	"moof": true,
+	"mdat": true,
+	"free": true,
+	"skip": true,
+}
+
+// validateFMP4 checks that the segment is a sequence of boxes with at least
+// one moof followed by an mdat.
+func validateFMP4(r *bufio.Reader) error {
+	header := make([]byte, 16)
+	hasMoof := false
+	hasMdat := false
+	for offset := int64(0); ; {
+		_, err := io.ReadFull(r, header[:8])
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			return badSegment("truncated box header at offset %d", offset)
+		}
+		if err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header))
+		boxType := string(header[4:8])
+		headerSize := int64(8)
+		if size == 1 {
+			_, err = io.ReadFull(r, header[8:16])
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return badSegment("truncated box header at offset %d", offset)
+			}
+			if err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:]))
+			headerSize = 16
+		}
+		if !segmentBoxes[boxType] {
+			return badSegment("unexpected box %q at offset %d", boxType, offset)
+		}
+		if boxType == "moof" {
+			hasMoof = true
+		} else if boxType == "mdat" {
+			if !hasMoof {
+				return badSegment("mdat before moof at offset %d", offset)
+			}
+			hasMdat = true
+		}
+		if size == 0 && boxType == "mdat" {
+			// The box extends to the end of the segment.
+			_, err = io.Copy(io.Discard, r)
+			if err != nil {
+				return err
+			}
+			break
+		}
+		if size < headerSize {
+			return badSegment("invalid size of box %s at offset %d", boxType, offset)
+		}
+		n, err := io.CopyN(io.Discard, r, size - headerSize)
+		if err == io.EOF {
+			return badSegment("truncated box %s at offset %d, %d bytes missing", boxType,
+				offset, size - headerSize - n)
+		}
+		if err != nil {
+			return err
+		}
+		offset += size
+	}
+	if !hasMoof || !hasMdat {
+		return badSegment("no moof and mdat box")
+	}
+	return nil
+}
+
+// validateAudio checks that packed audio is a sequence of ADTS, AC-3 or
+// E-AC-3 frames, optionally preceded by ID3 tags.
+func validateAudio(r *bufio.Reader) error {
+	offset := 0
+	for {
+		header, err := r.Peek(10)
+		if err != nil || string(header[:3]) != "ID3" {
+			break
+		}
+		size := int(header[6] & 0x7f) << 21 | int(header[7] & 0x7f) << 14 |
+			int(header[8] & 0x7f) << 7 | int(header[9] & 0x7f)
+		size += 10
+		if header[5] & 0x10 != 0 {
+			size += 10
+		}
+		n, err := r.Discard(size)
+		if err == io.EOF {
+			return badSegment("truncated ID3 tag at offset %d", offset)
+		}
+		if err != nil {
+			return err
+		}
+		offset += n
+	}
+	frameLength := func(header []byte) int {
+		_, length, err := mpegts.ParseADTSHeader(header)
+		if err != nil {
+			return 0
+		}
+		return length
+	}
+	if header, _ := r.Peek(2); bytes.Equal(header, []byte{0x0b, 0x77}) {
+		frameLength = mpegts.SyncFrameLength
+	}
+	frames := 0
+	for {
+		header, err := r.Peek(8)
+		if len(header) == 0 && err == io.EOF {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		length := frameLength(header)
+		if length == 0 {
+			return badSegment("no audio frame at offset %d", offset)
+		}
+		n, err := r.Discard(length)
+		if err == io.EOF {
+			return badSegment("truncated audio frame at offset %d", offset)
+		}
+		if err != nil {
+			return err
+		}
+		offset += n
+		frames++
+	}
+	if frames == 0 {
+		return badSegment("no audio frame")
+	}
+	return nil
+}
+
+// validateSegment checks that a decrypted segment is what its format
+// requires, reading it to the end.
+func validateSegment(r *bufio.Reader, segment request.Segment) error {
+	if segment.Map != nil {
+		return validateFMP4(r)
+	}
+	header, _ := r.Peek(3)
+	if bytes.HasPrefix(header, []byte("ID3")) || bytes.HasPrefix(header, []byte{0x0b, 0x77}) ||
+			len(header) >= 2 && header[0] == 0xff && header[1] & 0xf6 == 0xf0 {
+		return validateAudio(r)
+	}
+	return validateTS(r)
+}
+
+const quarantineDir = "quarantine"
+
+// quarantineName is the name of a segment of r in the quarantine folder.
+func quarantineName(r *rendition, segment request.Segment) string {
+	ext := path.Ext(segment.URI)
+	if ext == "" {
+		ext = ".ts"
+	}
+	return fmt.Sprintf("%s_%d_%d%s", r.Name, segment.DiscontinuitySeq, segment.SeqId, ext)
+}
+
+// quarantine writes the captured bytes of a segment that failed to decrypt
+// to the quarantine folder of outputDir, along with a text file telling why.
+// It returns false if err is not a badSegmentError.
+func quarantine(outputDir, name string, rs *renditionSegment, err error) bool {
+	var bad *badSegmentError
+	if !errors.As(err, &bad) {
+		return false
+	}
+	segment := rs.Segment
+	var reason strings.Builder
+	fmt.Fprintf(&reason, "segment: %s\n", rs.Playlist.AbsoluteURI(segment.URI))
+	fmt.Fprintf(&reason, "sequence: %d/%d\n", segment.DiscontinuitySeq, segment.SeqId)
+	if segment.Key != nil {
+		fmt.Fprintf(&reason, "key: %s\n", rs.Playlist.AbsoluteURI(segment.Key.URI))
+		fmt.Fprintf(&reason, "iv: %s\n", formatIV(segmentIV(segment.Key, segment.SeqId)))
+	}
+	fmt.Fprintf(&reason, "reason: %s\n", bad.Err)
+
+	dir := outputDir + "/" + quarantineDir
+	data, writeErr := readRawSegment(rs.Playlist, segment)
+	if writeErr == nil {
+		writeErr = os.MkdirAll(dir, 0755)
+	}
+	if writeErr == nil {
+		writeErr = os.WriteFile(dir + "/" + name, data, 0644)
+	}
+	if writeErr == nil {
+		writeErr = os.WriteFile(dir + "/" + name + ".txt", []byte(reason.String()), 0644)
+	}
+	if writeErr != nil {
+		fmt.Printf("Failed to quarantine %s: %s\n", name, writeErr)
+	} else {
+		fmt.Printf("Quarantined %s: %s\n", name, bad.Err)
+	}
+	return true
+}
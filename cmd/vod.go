@@ -0,0 +1,326 @@
+package cmd
+
+import (
+	"os"
+	"fmt"
+	"math"
+	"bytes"
+	"strings"
+	"net/url"
+	"encoding/hex"
+
+	"github.com/grafov/m3u8"
+
+	"hlsrecorder/request"
+)
+
+// vodVariant is what a captured master playlist says about a rendition.
+type vodVariant struct {
+	Params *m3u8.VariantParams
+	Alternative *m3u8.Alternative
+}
+
+// findVariants maps rendition URIs to the variant or alternative entries of
+// the master playlists found in the database.
+func findVariants(database *request.RequestDatabase) map[string]vodVariant {
+	variants := make(map[string]vodVariant)
+	idx := 0
+	for {
+		idx = database.FindRequest(idx, ".*\\.m3u8(\\?.*)?$")
+		if idx == -1 {
+			break
+		}
+		masterURI := database.Requests[idx].URI
+		body := database.ReadBody(idx)
+		idx++
+		if body == nil {
+			continue
+		}
+		p, listType, err := m3u8.Decode(*bytes.NewBuffer(body), false)
+		if err != nil || listType != m3u8.MASTER {
+			continue
+		}
+		for _, variant := range p.(*m3u8.MasterPlaylist).Variants {
+			if variant == nil {
+				continue
+			}
+			uri := streamKey(resolveURI(masterURI, variant.URI))
+			params := variant.VariantParams
+			variants[uri] = vodVariant{Params: &params}
+			for _, alternative := range variant.Alternatives {
+				if alternative == nil || alternative.URI == "" {
+					continue
+				}
+				uri := streamKey(resolveURI(masterURI, alternative.URI))
+				variants[uri] = vodVariant{Alternative: alternative}
+			}
+		}
+	}
+	return variants
+}
+
+// vodRendition is the result of exporting one rendition.
+type vodRendition struct {
+	Rendition *rendition
+	Playlist string
+	PeakBandwidth float64
+	AverageBandwidth float64
+	HasMap bool
+}
+
+type vodKey struct {
+	Method string
+	URI string
+	IV string
+	// Format is the KEYFORMAT of keys that are kept as they are.
+	Format string
+}
+
+func formatIV(iv []byte) string {
+	return "0x" + strings.ToUpper(hex.EncodeToString(iv))
+}
+
+func vodSegmentName(segment request.Segment) string {
+	if segment.Map != nil {
+		return fmt.Sprintf("segment_%d_%d.m4s", segment.DiscontinuitySeq, segment.SeqId)
+	}
+	return fmt.Sprintf("segment_%d_%d.ts", segment.DiscontinuitySeq, segment.SeqId)
+}
+
+// writeVODRendition writes the media playlist, segments, init sections and,
+// if the segments are kept encrypted, keys of a rendition to its directory in
+// outputDir. With reencrypt, the segments are encrypted under its keys, which
+// are not written.
+func writeVODRendition(r *rendition, outputDir string, keepEncrypted bool) (*vodRendition, error) {
+	dir := outputDir + "/" + r.Name
+	segments := r.sortedSegments()
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	var playlist strings.Builder
+	var body strings.Builder
+	result := &vodRendition {
+		Rendition: r,
+		Playlist: "index.m3u8",
+	}
+	targetDuration := 0.0
+	totalBits := 0.0
+	totalDuration := 0.0
+	inits := make(map[string]string)
+	keys := make(map[string]string)
+	var lastKey *vodKey
+	lastInit := ""
+	var previous *request.Segment
+	read := readSegment
+	if keepEncrypted {
+		read = readRawSegment
+	}
+	type written struct {
+		Size int
+		Err error
+	}
+	// Segments are read and written by the workers, the playlist is built
+	// in order.
+	err = pipeline(len(segments), jobs, func(i int) interface{} {
+		segment := segments[i].Segment
+		data, err := read(segments[i].Playlist, segment)
+		if err == nil && reencrypt != nil {
+			key := reencrypt.key(reencrypt.keyIndex(uint64(i)))
+			data, err = encryptAES128CBC(data, key, reencrypt.iv(segment.DiscontinuitySeq, segment.SeqId))
+		}
+		if err == nil {
+			err = os.WriteFile(dir + "/" + vodSegmentName(segment), data, 0644)
+		}
+		return written{len(data), err}
+	}, func(i int, value interface{}) error {
+		rs := segments[i]
+		segment := rs.Segment
+		size := value.(written).Size
+		if err := value.(written).Err; err != nil {
+			if !quarantine(outputDir, quarantineName(r, segment), rs, err) {
+				fmt.Printf("Failed to export %s: %s\n", segment.URI, err)
+			}
+			return nil
+		}
+		name := vodSegmentName(segment)
+
+		if previous != nil && (previous.DiscontinuitySeq != segment.DiscontinuitySeq ||
+				previous.SeqId + 1 != segment.SeqId) {
+			body.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if segment.Map != nil {
+			initName, ok := inits[segment.Map.URI]
+			if !ok {
+				init, err := readInit(rs.Playlist, segment)
+				if err != nil {
+					return err
+				}
+				initName = fmt.Sprintf("init_%d.mp4", len(inits))
+				err = os.WriteFile(dir + "/" + initName, init, 0644)
+				if err != nil {
+					return err
+				}
+				inits[segment.Map.URI] = initName
+			}
+			if initName != lastInit {
+				if lastKey != nil {
+					// Init sections are written in the clear.
+					body.WriteString("#EXT-X-KEY:METHOD=NONE\n")
+					lastKey = nil
+				}
+				fmt.Fprintf(&body, "#EXT-X-MAP:URI=\"%s\"\n", initName)
+				lastInit = initName
+			}
+			result.HasMap = true
+		}
+		if keepEncrypted || reencrypt != nil {
+			var key *vodKey
+			if reencrypt != nil {
+				key = &vodKey{"AES-128", reencrypt.keyURI(reencrypt.keyIndex(uint64(i))),
+					formatIV(reencrypt.iv(segment.DiscontinuitySeq, segment.SeqId)), ""}
+			} else if undecryptable(rs.Playlist, segment.Key) {
+				// The key is fetched by the player from where it always was.
+				key = &vodKey{segment.Key.Method, rs.Playlist.AbsoluteURI(segment.Key.URI),
+					formatIV(segmentIV(segment.Key, segment.SeqId)), segment.Key.Keyformat}
+			} else if segment.Key != nil {
+				keyName, ok := keys[segment.Key.URI]
+				if !ok {
+					keyData := segmentKeyData(rs.Playlist, segment.Key)
+					if keyData == nil {
+						return fmt.Errorf("key %s was not captured", segment.Key.URI)
+					}
+					keyName = fmt.Sprintf("key_%d.key", len(keys))
+					err = os.WriteFile(dir + "/" + keyName, keyData, 0644)
+					if err != nil {
+						return err
+					}
+					keys[segment.Key.URI] = keyName
+				}
+				// Segment numbers change in the exported playlist, so the
+				// IV is always written explicitly.
+				key = &vodKey{segment.Key.Method, keyName, formatIV(segmentIV(segment.Key, segment.SeqId)), ""}
+			}
+			if key == nil && lastKey != nil {
+				body.WriteString("#EXT-X-KEY:METHOD=NONE\n")
+			} else if key != nil && (lastKey == nil || *key != *lastKey) {
+				fmt.Fprintf(&body, "#EXT-X-KEY:METHOD=%s,URI=\"%s\",IV=%s", key.Method, key.URI, key.IV)
+				if key.Format != "" {
+					fmt.Fprintf(&body, ",KEYFORMAT=\"%s\"", key.Format)
+				}
+				body.WriteString("\n")
+			}
+			lastKey = key
+		}
+		fmt.Fprintf(&body, "#EXTINF:%.3f,\n%s\n", segment.Duration, name)
+
+		if segment.Duration > targetDuration {
+			targetDuration = segment.Duration
+		}
+		if segment.Duration > 0 {
+			bits := float64(size) * 8
+			totalBits += bits
+			totalDuration += segment.Duration
+			result.PeakBandwidth = math.Max(result.PeakBandwidth, bits / segment.Duration)
+		}
+		previous = &rs.Segment
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if previous == nil {
+		return nil, nil
+	}
+	if totalDuration > 0 {
+		result.AverageBandwidth = totalBits / totalDuration
+	}
+	version := 3
+	if result.HasMap {
+		version = 7
+	}
+	playlist.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&playlist, "#EXT-X-VERSION:%d\n", version)
+	fmt.Fprintf(&playlist, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(targetDuration)))
+	playlist.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	playlist.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	playlist.WriteString(body.String())
+	playlist.WriteString("#EXT-X-ENDLIST\n")
+	err = os.WriteFile(dir + "/" + result.Playlist, []byte(playlist.String()), 0644)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func quoteAttribute(value string) string {
+	return "\"" + strings.ReplaceAll(value, "\"", "'") + "\""
+}
+
+// writeVOD exports the renditions as a VOD package with a master playlist that
+// any static web server can host.
+func writeVOD(renditions []*rendition, database *request.RequestDatabase,
+				outputDir string, keepEncrypted bool) error {
+	variants := findVariants(database)
+	var media strings.Builder
+	var streams strings.Builder
+	version := 3
+	for _, r := range renditions {
+		result, err := writeVODRendition(r, outputDir, keepEncrypted)
+		if err != nil {
+			fmt.Printf("Failed to export %s: %s\n", r.URI, err)
+			continue
+		}
+		if result == nil {
+			continue
+		}
+		if result.HasMap {
+			version = 7
+		}
+		uri := (&url.URL{Path: r.Name + "/" + result.Playlist}).String()
+		variant := variants[r.URI]
+		if alternative := variant.Alternative; alternative != nil {
+			attributes := []string {
+				"TYPE=" + alternative.Type,
+				"GROUP-ID=" + quoteAttribute(alternative.GroupId),
+				"NAME=" + quoteAttribute(alternative.Name),
+			}
+			if alternative.Language != "" {
+				attributes = append(attributes, "LANGUAGE=" + quoteAttribute(alternative.Language))
+			}
+			if alternative.Default {
+				attributes = append(attributes, "DEFAULT=YES")
+			}
+			if alternative.Autoselect != "" {
+				attributes = append(attributes, "AUTOSELECT=" + alternative.Autoselect)
+			}
+			attributes = append(attributes, "URI=" + quoteAttribute(uri))
+			fmt.Fprintf(&media, "#EXT-X-MEDIA:%s\n", strings.Join(attributes, ","))
+			continue
+		}
+		attributes := []string {
+			fmt.Sprintf("BANDWIDTH=%d", int64(math.Ceil(result.PeakBandwidth))),
+			fmt.Sprintf("AVERAGE-BANDWIDTH=%d", int64(math.Ceil(result.AverageBandwidth))),
+		}
+		if params := variant.Params; params != nil {
+			if params.Resolution != "" {
+				attributes = append(attributes, "RESOLUTION=" + params.Resolution)
+			}
+			if params.Codecs != "" {
+				attributes = append(attributes, "CODECS=" + quoteAttribute(params.Codecs))
+			}
+			if params.FrameRate > 0 {
+				attributes = append(attributes, fmt.Sprintf("FRAME-RATE=%.3f", params.FrameRate))
+			}
+			if params.Audio != "" {
+				attributes = append(attributes, "AUDIO=" + quoteAttribute(params.Audio))
+			}
+			if params.Subtitles != "" {
+				attributes = append(attributes, "SUBTITLES=" + quoteAttribute(params.Subtitles))
+			}
+		}
+		fmt.Fprintf(&streams, "#EXT-X-STREAM-INF:%s\n%s\n", strings.Join(attributes, ","), uri)
+	}
+	master := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:%d\n%s%s", version, media.String(), streams.String())
+	return os.WriteFile(outputDir + "/master.m3u8", []byte(master), 0644)
+}
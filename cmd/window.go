@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+	"strconv"
+)
+
+// parseTimeArg parses a wall-clock time in RFC3339 format, or an offset from
+// base given as a duration like "1h20m" or as seconds.
+func parseTimeArg(arg string, base time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, arg); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(arg); err == nil {
+		return base.Add(d), nil
+	}
+	if seconds, err := strconv.ParseFloat(arg, 64); err == nil {
+		return base.Add(time.Duration(seconds * float64(time.Second))), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %s, expected RFC3339 or an offset", arg)
+}
+
+// filterWindow keeps only the segments that overlap the window between from
+// and to. A zero time leaves that side of the window open.
+func (r *rendition) filterWindow(from, to time.Time) {
+	overlaps := func(start, end time.Time) bool {
+		return (from.IsZero() || end.After(from)) && (to.IsZero() || start.Before(to))
+	}
+	for key, rs := range r.Segments {
+		if !overlaps(rs.Segment.Start, rs.Segment.End()) {
+			delete(r.Segments, key)
+		}
+	}
+	for key, segment := range r.Referenced {
+		if !overlaps(segment.Start, segment.End()) {
+			delete(r.Referenced, key)
+		}
+	}
+}
@@ -5,13 +5,15 @@ go 1.19
 require (
 	github.com/AdguardTeam/golibs v0.4.0
 	github.com/AdguardTeam/gomitmproxy v0.2.1
+	github.com/andybalholm/brotli v1.1.0
 	github.com/grafov/m3u8 v0.12.0
 	github.com/spf13/cobra v1.8.0
+	golang.org/x/net v0.17.0
 )
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/text v0.3.2 // indirect
+	golang.org/x/text v0.13.0 // indirect
 )
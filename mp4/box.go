@@ -0,0 +1,60 @@
+package mp4
+
+import (
+	"encoding/binary"
+)
+
+func u8(v uint8) []byte {
+	return []byte{v}
+}
+
+func u16(v uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, v)
+}
+
+func u32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func u64(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
+
+func zeros(n int) []byte {
+	return make([]byte, n)
+}
+
+// box serializes a box of the given type with its children concatenated as
+// payload.
+func box(boxType string, children ...[]byte) []byte {
+	size := 8
+	for _, child := range children {
+		size += len(child)
+	}
+	b := make([]byte, 0, size)
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	b = append(b, boxType...)
+	for _, child := range children {
+		b = append(b, child...)
+	}
+	return b
+}
+
+func fullBox(boxType string, version uint8, flags uint32, children ...[]byte) []byte {
+	header := u32(uint32(version) << 24 | flags)
+	return box(boxType, append([][]byte{header}, children...)...)
+}
+
+var identityMatrix = []uint32 {
+	0x00010000, 0, 0,
+	0, 0x00010000, 0,
+	0, 0, 0x40000000,
+}
+
+func matrix() []byte {
+	var b []byte
+	for _, v := range identityMatrix {
+		b = append(b, u32(v)...)
+	}
+	return b
+}
@@ -0,0 +1,113 @@
+package mp4
+
+func visualSampleEntry(format string, width, height int, config []byte) []byte {
+	return box(format,
+		zeros(6), u16(1),
+		zeros(16),
+		u16(uint16(width)), u16(uint16(height)),
+		u32(0x00480000), u32(0x00480000),
+		u32(0),
+		u16(1),
+		zeros(32),
+		u16(0x0018), u16(0xffff),
+		config)
+}
+
+func audioSampleEntry(format string, channels, sampleRate int, config []byte) []byte {
+	return box(format,
+		zeros(6), u16(1),
+		zeros(8),
+		u16(uint16(channels)), u16(16),
+		zeros(4),
+		u32(uint32(sampleRate) << 16),
+		config)
+}
+
+// AVCSampleEntry returns an avc1 sample entry for the given parameter sets.
+// chromaFormat and the bit depths are only written for the high profiles.
+func AVCSampleEntry(width, height int, sps, pps [][]byte, chromaFormat, bitDepthLuma, bitDepthChroma int) []byte {
+	config := []byte{1, sps[0][1], sps[0][2], sps[0][3], 0xff, 0xe0 | byte(len(sps))}
+	for _, nal := range sps {
+		config = append(config, u16(uint16(len(nal)))...)
+		config = append(config, nal...)
+	}
+	config = append(config, byte(len(pps)))
+	for _, nal := range pps {
+		config = append(config, u16(uint16(len(nal)))...)
+		config = append(config, nal...)
+	}
+	switch sps[0][1] {
+	case 100, 110, 122, 144:
+		config = append(config, 0xfc | byte(chromaFormat), 0xf8 | byte(bitDepthLuma - 8),
+			0xf8 | byte(bitDepthChroma - 8), 0)
+	}
+	return visualSampleEntry("avc1", width, height, box("avcC", config))
+}
+
+// HEVCSampleEntry returns an hvc1 sample entry for the given parameter sets.
+// profileTierLevel is the 12-byte general profile_tier_level of the SPS.
+func HEVCSampleEntry(width, height int, vps, sps, pps [][]byte, profileTierLevel []byte,
+				chromaFormat, bitDepthLuma, bitDepthChroma, subLayers int, temporalIdNesting bool) []byte {
+	config := []byte{1}
+	config = append(config, profileTierLevel...)
+	config = append(config,
+		0xf0, 0x00,
+		0xfc,
+		0xfc | byte(chromaFormat),
+		0xf8 | byte(bitDepthLuma - 8),
+		0xf8 | byte(bitDepthChroma - 8),
+		0x00, 0x00)
+	flags := byte(subLayers & 7) << 3 | 3
+	if temporalIdNesting {
+		flags |= 0x04
+	}
+	config = append(config, flags)
+	arrays := []struct {
+		Type byte
+		NALs [][]byte
+	} {
+		{32, vps},
+		{33, sps},
+		{34, pps},
+	}
+	config = append(config, byte(len(arrays)))
+	for _, array := range arrays {
+		config = append(config, 0x80 | array.Type)
+		config = append(config, u16(uint16(len(array.NALs)))...)
+		for _, nal := range array.NALs {
+			config = append(config, u16(uint16(len(nal)))...)
+			config = append(config, nal...)
+		}
+	}
+	return visualSampleEntry("hvc1", width, height, box("hvcC", config))
+}
+
+func descriptor(tag byte, children ...[]byte) []byte {
+	size := 0
+	for _, child := range children {
+		size += len(child)
+	}
+	b := []byte{tag, 0x80, 0x80, 0x80, byte(size)}
+	for _, child := range children {
+		b = append(b, child...)
+	}
+	return b
+}
+
+// AACSampleEntry returns an mp4a sample entry for an MPEG-4
+// AudioSpecificConfig.
+func AACSampleEntry(channels, sampleRate int, audioSpecificConfig []byte) []byte {
+	esds := fullBox("esds", 0, 0,
+		descriptor(0x03,
+			u16(0), u8(0),
+			descriptor(0x04,
+				u8(0x40), u8(0x15), zeros(3), u32(0), u32(0),
+				descriptor(0x05, audioSpecificConfig)),
+			descriptor(0x06, u8(0x02))))
+	return audioSampleEntry("mp4a", channels, sampleRate, esds)
+}
+
+// AC3SampleEntry returns an ac-3 sample entry for the 3-byte dac3 payload.
+func AC3SampleEntry(channels, sampleRate int, dac3 []byte) []byte {
+	return audioSampleEntry("ac-3", channels, sampleRate, box("dac3", dac3))
+}
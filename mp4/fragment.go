@@ -0,0 +1,89 @@
+package mp4
+
+import (
+	"io"
+)
+
+// Fragment holds the samples of one track for a movie fragment. BaseTime is
+// the decode time of the first sample in the track timescale.
+type Fragment struct {
+	Track *Track
+	BaseTime int64
+	Samples []Sample
+	Data [][]byte
+}
+
+// WriteInit writes the initialization segment of a fragmented MP4 file.
+// Sample tables of the tracks are ignored.
+func WriteInit(w io.Writer, tracks []*Track) error {
+	empty := make([]*Track, len(tracks))
+	for i, track := range tracks {
+		t := *track
+		t.Samples = nil
+		t.StartTime = 0
+		empty[i] = &t
+	}
+	_, err := w.Write(append(append([]byte(nil), ftyp...), moov(empty, true)...))
+	return err
+}
+
+func sampleFlags(sample Sample) uint32 {
+	if sample.Sync {
+		return 0x02000000
+	}
+	return 0x01010000
+}
+
+func moof(sequence uint32, fragments []Fragment, dataOffsets []int32) []byte {
+	children := [][]byte{fullBox("mfhd", 0, 0, u32(sequence))}
+	for i, fragment := range fragments {
+		var entries []byte
+		for _, sample := range fragment.Samples {
+			entries = append(entries, u32(sample.Duration)...)
+			entries = append(entries, u32(sample.Size)...)
+			entries = append(entries, u32(sampleFlags(sample))...)
+			entries = append(entries, u32(uint32(sample.CompositionOffset))...)
+		}
+		children = append(children, box("traf",
+			fullBox("tfhd", 0, 0x020000, u32(fragment.Track.ID)),
+			fullBox("tfdt", 1, 0, u64(uint64(fragment.BaseTime))),
+			fullBox("trun", 1, 0x000f01,
+				u32(uint32(len(fragment.Samples))), u32(uint32(dataOffsets[i])), entries)))
+	}
+	return box("moof", children...)
+}
+
+// WriteFragment writes a movie fragment holding the samples of one or more
+// tracks. Sample sizes are taken from the data.
+func WriteFragment(w io.Writer, sequence uint32, fragments []Fragment) error {
+	size := 0
+	dataOffsets := make([]int32, len(fragments))
+	for i := range fragments {
+		fragment := &fragments[i]
+		dataOffsets[i] = int32(size)
+		for j, data := range fragment.Data {
+			fragment.Samples[j].Size = uint32(len(data))
+			size += len(data)
+		}
+	}
+	header := moof(sequence, fragments, dataOffsets)
+	for i := range dataOffsets {
+		dataOffsets[i] += int32(len(header) + 8)
+	}
+	header = moof(sequence, fragments, dataOffsets)
+	header = append(header, u32(uint32(size + 8))...)
+	header = append(header, "mdat"...)
+	_, err := w.Write(header)
+	if err != nil {
+		return err
+	}
+	for _, fragment := range fragments {
+		for _, data := range fragment.Data {
+			_, err = w.Write(data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+package mp4
+
+import (
+	"io"
+	"math"
+	"errors"
+)
+
+const movieTimescale = 1000
+
+// Track is a track of a movie. SampleEntry is one of the *SampleEntry
+// results. Handler is "vide" or "soun".
+type Track struct {
+	ID uint32
+	Handler string
+	Timescale uint32
+	SampleEntry []byte
+	Width int
+	Height int
+	// StartTime is the decode time of the first sample in the track
+	// timescale. The progressive writer delays the track by it.
+	StartTime int64
+	Samples []Sample
+}
+
+// Sample is a sample of a track. Offset is set by the writer.
+type Sample struct {
+	Duration uint32
+	CompositionOffset int32
+	Size uint32
+	Sync bool
+	Offset int64
+}
+
+func (t *Track) duration() uint64 {
+	var duration uint64
+	for _, sample := range t.Samples {
+		duration += uint64(sample.Duration)
+	}
+	return duration
+}
+
+// Writer writes a progressive MP4 file. Sample data is written as it comes
+// and the sample tables are written at the end of the file.
+type Writer struct {
+	w io.WriteSeeker
+	mdatStart int64
+	offset int64
+	Tracks []*Track
+}
+
+var ftyp = box("ftyp", []byte("isom"), u32(0x200), []byte("isomiso2avc1mp41"))
+
+func NewWriter(w io.WriteSeeker) (*Writer, error) {
+	_, err := w.Write(ftyp)
+	if err != nil {
+		return nil, err
+	}
+	// The mdat size is patched on Close, so the 64-bit size is used right
+	// away.
+	_, err = w.Write(append(u32(1), append([]byte("mdat"), u64(0)...)...))
+	if err != nil {
+		return nil, err
+	}
+	start := int64(len(ftyp))
+	return &Writer {
+		w: w,
+		mdatStart: start,
+		offset: start + 16,
+	}, nil
+}
+
+// AddTrack adds a track. Tracks can be added until Close.
+func (w *Writer) AddTrack(track *Track) {
+	track.ID = uint32(len(w.Tracks) + 1)
+	w.Tracks = append(w.Tracks, track)
+}
+
+// WriteSample writes the data of a sample and adds it to the sample table of
+// track.
+func (w *Writer) WriteSample(track *Track, sample Sample, data []byte) error {
+	_, err := w.w.Write(data)
+	if err != nil {
+		return err
+	}
+	sample.Offset = w.offset
+	sample.Size = uint32(len(data))
+	track.Samples = append(track.Samples, sample)
+	w.offset += int64(len(data))
+	return nil
+}
+
+// Close patches the mdat size and writes the movie box.
+func (w *Writer) Close() error {
+	if len(w.Tracks) == 0 {
+		return errors.New("no tracks")
+	}
+	_, err := w.w.Seek(w.mdatStart + 8, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(u64(uint64(w.offset - w.mdatStart)))
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Seek(w.offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(moov(w.Tracks, false))
+	return err
+}
+
+// movieDuration returns the duration of a track in the movie timescale,
+// including its start delay.
+func movieDuration(track *Track, withStart bool) uint64 {
+	duration := track.duration()
+	if withStart && track.StartTime > 0 {
+		duration += uint64(track.StartTime)
+	}
+	return duration * movieTimescale / uint64(track.Timescale)
+}
+
+func moov(tracks []*Track, fragmented bool) []byte {
+	var duration uint64
+	for _, track := range tracks {
+		if d := movieDuration(track, !fragmented); d > duration {
+			duration = d
+		}
+	}
+	children := [][]byte {
+		fullBox("mvhd", 1, 0,
+			u64(0), u64(0),
+			u32(movieTimescale), u64(duration),
+			u32(0x00010000), u16(0x0100), zeros(10),
+			matrix(),
+			zeros(24),
+			u32(uint32(len(tracks) + 1))),
+	}
+	for _, track := range tracks {
+		children = append(children, trak(track, fragmented))
+	}
+	if fragmented {
+		var trex [][]byte
+		for _, track := range tracks {
+			trex = append(trex, fullBox("trex", 0, 0,
+				u32(track.ID), u32(1), u32(0), u32(0), u32(0)))
+		}
+		children = append(children, box("mvex", trex...))
+	}
+	return box("moov", children...)
+}
+
+func trak(track *Track, fragmented bool) []byte {
+	volume := uint16(0)
+	if track.Handler == "soun" {
+		volume = 0x0100
+	}
+	tkhd := fullBox("tkhd", 1, 3,
+		u64(0), u64(0),
+		u32(track.ID), u32(0),
+		u64(movieDuration(track, !fragmented)),
+		zeros(8),
+		u16(0), u16(0), u16(volume), u16(0),
+		matrix(),
+		u32(uint32(track.Width) << 16), u32(uint32(track.Height) << 16))
+	children := [][]byte{tkhd}
+	if !fragmented && track.StartTime > 0 {
+		// An empty edit delays the track so that it stays in sync with the
+		// others.
+		delay := uint64(track.StartTime) * movieTimescale / uint64(track.Timescale)
+		children = append(children, box("edts", fullBox("elst", 1, 0,
+			u32(2),
+			u64(delay), u64(0xffffffffffffffff), u32(0x00010000),
+			u64(movieDuration(track, false)), u64(0), u32(0x00010000))))
+	}
+	name := "VideoHandler"
+	header := fullBox("vmhd", 0, 1, zeros(8))
+	if track.Handler == "soun" {
+		name = "SoundHandler"
+		header = fullBox("smhd", 0, 0, zeros(4))
+	}
+	mdhd := fullBox("mdhd", 1, 0,
+		u64(0), u64(0),
+		u32(track.Timescale), u64(track.duration()),
+		u16(0x55c4), u16(0))
+	hdlr := fullBox("hdlr", 0, 0,
+		u32(0), []byte(track.Handler), zeros(12), []byte(name), u8(0))
+	dinf := box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 1)))
+	minf := box("minf", header, dinf, stbl(track))
+	children = append(children, box("mdia", mdhd, hdlr, minf))
+	return box("trak", children...)
+}
+
+func stbl(track *Track) []byte {
+	samples := track.Samples
+	stsd := fullBox("stsd", 0, 0, u32(1), track.SampleEntry)
+
+	var stts []byte
+	entries := uint32(0)
+	for i := 0; i < len(samples); {
+		j := i
+		for j < len(samples) && samples[j].Duration == samples[i].Duration {
+			j++
+		}
+		stts = append(stts, u32(uint32(j - i))...)
+		stts = append(stts, u32(samples[i].Duration)...)
+		entries++
+		i = j
+	}
+	children := [][]byte{stsd, fullBox("stts", 0, 0, u32(entries), stts)}
+
+	hasOffsets := false
+	for _, sample := range samples {
+		if sample.CompositionOffset != 0 {
+			hasOffsets = true
+			break
+		}
+	}
+	if hasOffsets {
+		var ctts []byte
+		entries = 0
+		for i := 0; i < len(samples); {
+			j := i
+			for j < len(samples) && samples[j].CompositionOffset == samples[i].CompositionOffset {
+				j++
+			}
+			ctts = append(ctts, u32(uint32(j - i))...)
+			ctts = append(ctts, u32(uint32(samples[i].CompositionOffset))...)
+			entries++
+			i = j
+		}
+		children = append(children, fullBox("ctts", 1, 0, u32(entries), ctts))
+	}
+
+	if track.Handler == "vide" {
+		var stss []byte
+		entries = 0
+		for i, sample := range samples {
+			if sample.Sync {
+				stss = append(stss, u32(uint32(i + 1))...)
+				entries++
+			}
+		}
+		if int(entries) != len(samples) {
+			children = append(children, fullBox("stss", 0, 0, u32(entries), stss))
+		}
+	}
+
+	// Samples that follow each other in the file form a chunk.
+	var chunks []int64
+	var chunkSizes []uint32
+	for i, sample := range samples {
+		previous := Sample{}
+		if i > 0 {
+			previous = samples[i - 1]
+		}
+		if i == 0 || previous.Offset + int64(previous.Size) != sample.Offset {
+			chunks = append(chunks, sample.Offset)
+			chunkSizes = append(chunkSizes, 0)
+		}
+		chunkSizes[len(chunkSizes) - 1]++
+	}
+	var stsc []byte
+	entries = 0
+	for i := range chunkSizes {
+		if i > 0 && chunkSizes[i] == chunkSizes[i - 1] {
+			continue
+		}
+		stsc = append(stsc, u32(uint32(i + 1))...)
+		stsc = append(stsc, u32(chunkSizes[i])...)
+		stsc = append(stsc, u32(1)...)
+		entries++
+	}
+	children = append(children, fullBox("stsc", 0, 0, u32(entries), stsc))
+
+	var stsz []byte
+	for _, sample := range samples {
+		stsz = append(stsz, u32(sample.Size)...)
+	}
+	children = append(children, fullBox("stsz", 0, 0, u32(0), u32(uint32(len(samples))), stsz))
+
+	children = append(children, chunkOffsets(chunks))
+	return box("stbl", children...)
+}
+
+// chunkOffsets returns an stco box, or a co64 box if an offset does not fit
+// in 32 bits.
+func chunkOffsets(chunks []int64) []byte {
+	large := len(chunks) > 0 && chunks[len(chunks) - 1] > math.MaxUint32
+	var offsets []byte
+	for _, offset := range chunks {
+		if large {
+			offsets = append(offsets, u64(uint64(offset))...)
+		} else {
+			offsets = append(offsets, u32(uint32(offset))...)
+		}
+	}
+	if large {
+		return fullBox("co64", 0, 0, u32(uint32(len(chunks))), offsets)
+	}
+	return fullBox("stco", 0, 0, u32(uint32(len(chunks))), offsets)
+}
@@ -0,0 +1,214 @@
+package mp4
+
+import (
+	"os"
+	"bytes"
+	"testing"
+	"encoding/binary"
+)
+
+// findBox returns the payload of the box at path within data, which holds
+// boxes one after the other.
+func findBox(data []byte, path ...string) []byte {
+	for i := 0; i + 8 <= len(data); {
+		size := int(binary.BigEndian.Uint32(data[i:]))
+		boxType := string(data[i + 4:i + 8])
+		header := 8
+		if size == 1 {
+			size = int(binary.BigEndian.Uint64(data[i + 8:]))
+			header = 16
+		}
+		if size < header || i + size > len(data) {
+			return nil
+		}
+		if boxType == path[0] {
+			payload := data[i + header:i + size]
+			if len(path) == 1 {
+				return payload
+			}
+			return findBox(payload, path[1:]...)
+		}
+		i += size
+	}
+	return nil
+}
+
+func TestBox(t *testing.T) {
+	tests := []struct {
+		name string
+		got []byte
+		want []byte
+	} {
+		{"empty", box("free"), []byte{0, 0, 0, 8, 'f', 'r', 'e', 'e'}},
+		{"children", box("test", []byte{1, 2}, []byte{3}),
+			[]byte{0, 0, 0, 11, 't', 'e', 's', 't', 1, 2, 3}},
+		{"nested", box("moov", box("free")),
+			[]byte{0, 0, 0, 16, 'm', 'o', 'o', 'v', 0, 0, 0, 8, 'f', 'r', 'e', 'e'}},
+		{"full box", fullBox("mfhd", 1, 0x020001, u32(7)),
+			[]byte{0, 0, 0, 16, 'm', 'f', 'h', 'd', 1, 2, 0, 1, 0, 0, 0, 7}},
+		{"integers", append(append(u8(1), u16(0x0203)...), u64(0x0405060708090a0b)...),
+			[]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}},
+	}
+	for _, test := range tests {
+		if !bytes.Equal(test.got, test.want) {
+			t.Errorf("%s: got % x, want % x", test.name, test.got, test.want)
+		}
+	}
+}
+
+func TestChunkOffsets(t *testing.T) {
+	tests := []struct {
+		name string
+		chunks []int64
+		boxType string
+		want []byte
+	} {
+		{"none", nil, "stco", []byte{0, 0, 0, 0, 0, 0, 0, 0}},
+		{"small", []int64{48, 1000}, "stco",
+			[]byte{0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 48, 0, 0, 3, 0xe8}},
+		{"largest 32-bit", []int64{0xffffffff}, "stco",
+			[]byte{0, 0, 0, 0, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff}},
+		{"large", []int64{48, 0x100000000}, "co64",
+			[]byte{0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 48, 0, 0, 0, 1, 0, 0, 0, 0}},
+	}
+	for _, test := range tests {
+		b := chunkOffsets(test.chunks)
+		if boxType := string(b[4:8]); boxType != test.boxType {
+			t.Errorf("%s: got %s, want %s", test.name, boxType, test.boxType)
+			continue
+		}
+		if payload := findBox(b, test.boxType); !bytes.Equal(payload, test.want) {
+			t.Errorf("%s: got % x, want % x", test.name, payload, test.want)
+		}
+	}
+}
+
+func TestEditList(t *testing.T) {
+	samples := []Sample {
+		{Duration: 3000},
+		{Duration: 3000},
+	}
+	tests := []struct {
+		name string
+		timescale uint32
+		startTime int64
+		fragmented bool
+		// delay and duration are in the movie timescale, delay is -1 if
+		// no edit list is expected.
+		delay int64
+		duration uint64
+	} {
+		{"no delay", 90000, 0, false, -1, 0},
+		{"delay", 90000, 9000, false, 100, 66},
+		{"audio timescale", 48000, 4800, false, 100, 125},
+		{"fragmented", 90000, 9000, true, -1, 0},
+	}
+	for _, test := range tests {
+		track := &Track {
+			ID: 1,
+			Handler: "vide",
+			Timescale: test.timescale,
+			StartTime: test.startTime,
+			Samples: samples,
+		}
+		elst := findBox(trak(track, test.fragmented), "trak", "edts", "elst")
+		if test.delay == -1 {
+			if elst != nil {
+				t.Errorf("%s: unexpected edit list", test.name)
+			}
+			continue
+		}
+		if len(elst) != 48 {
+			t.Errorf("%s: got edit list of %d bytes", test.name, len(elst))
+			continue
+		}
+		if version := elst[0]; version != 1 {
+			t.Errorf("%s: got version %d", test.name, version)
+		}
+		if entries := binary.BigEndian.Uint32(elst[4:]); entries != 2 {
+			t.Errorf("%s: got %d entries", test.name, entries)
+		}
+		if delay := binary.BigEndian.Uint64(elst[8:]); delay != uint64(test.delay) {
+			t.Errorf("%s: got delay %d, want %d", test.name, delay, test.delay)
+		}
+		if mediaTime := int64(binary.BigEndian.Uint64(elst[16:])); mediaTime != -1 {
+			t.Errorf("%s: got empty edit media time %d", test.name, mediaTime)
+		}
+		if duration := binary.BigEndian.Uint64(elst[28:]); duration != test.duration {
+			t.Errorf("%s: got duration %d, want %d", test.name, duration, test.duration)
+		}
+		if mediaTime := binary.BigEndian.Uint64(elst[36:]); mediaTime != 0 {
+			t.Errorf("%s: got media time %d", test.name, mediaTime)
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	tests := []struct {
+		name string
+		samples [][]byte
+		sync []bool
+	} {
+		{"single sample", [][]byte{{1, 2, 3}}, []bool{true}},
+		{"sync samples", [][]byte{{1}, {2, 3}, {4, 5, 6}}, []bool{true, false, true}},
+	}
+	for _, test := range tests {
+		file, err := os.Create(t.TempDir() + "/test.mp4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := NewWriter(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		track := &Track {
+			Handler: "vide",
+			Timescale: 90000,
+			SampleEntry: box("avc1"),
+		}
+		w.AddTrack(track)
+		var mdat []byte
+		for i, data := range test.samples {
+			err = w.WriteSample(track, Sample{Duration: 3000, Sync: test.sync[i]}, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mdat = append(mdat, data...)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		data, err := os.ReadFile(file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := findBox(data, "mdat"); !bytes.Equal(got, mdat) {
+			t.Errorf("%s: got mdat % x, want % x", test.name, got, mdat)
+		}
+		stbl := findBox(data, "moov", "trak", "mdia", "minf", "stbl")
+		stsz := findBox(stbl, "stsz")
+		if count := binary.BigEndian.Uint32(stsz[8:]); int(count) != len(test.samples) {
+			t.Errorf("%s: got %d sizes, want %d", test.name, count, len(test.samples))
+		}
+		// All samples follow each other, so they form a single chunk.
+		stco := findBox(stbl, "stco")
+		if stco == nil || binary.BigEndian.Uint32(stco[4:]) != 1 {
+			t.Errorf("%s: got chunk offsets % x", test.name, stco)
+			continue
+		}
+		offset := binary.BigEndian.Uint32(stco[8:])
+		if !bytes.Equal(data[offset:int(offset) + len(mdat)], mdat) {
+			t.Errorf("%s: chunk offset %d does not point at the samples", test.name, offset)
+		}
+		stss := findBox(stbl, "stss")
+		allSync := true
+		for _, sync := range test.sync {
+			allSync = allSync && sync
+		}
+		if allSync != (stss == nil) {
+			t.Errorf("%s: got sync sample table % x", test.name, stss)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package mpegts
+
+import (
+	"errors"
+)
+
+var adtsSampleRates = []int {
+	96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+// AudioFrame is a single compressed audio frame.
+type AudioFrame struct {
+	SampleRate int
+	Channels int
+	// Samples is the number of PCM samples the frame decodes to.
+	Samples int
+	// Header is the ADTS header or AC-3 sync frame header. Data holds the
+	// frame without ADTS header, but including the AC-3 header.
+	Header []byte
+	Data []byte
+	// AAC only.
+	ObjectType int
+	SamplingIndex int
+	ChannelConfig int
+	// AC-3 only.
+	AC3Config []byte
+}
+
+// AudioSpecificConfig returns the MPEG-4 AudioSpecificConfig of an AAC
+// frame.
+func (f *AudioFrame) AudioSpecificConfig() []byte {
+	config := f.ObjectType << 11 | f.SamplingIndex << 7 | f.ChannelConfig << 3
+	return []byte{byte(config >> 8), byte(config)}
+}
+
+var errNoSync = errors.New("no audio sync word")
+
+// ParseADTSHeader parses the ADTS header at the start of data and returns the
+// frame length including the header.
+func ParseADTSHeader(data []byte) (AudioFrame, int, error) {
+	var frame AudioFrame
+	if len(data) < 7 || data[0] != 0xff || data[1] & 0xf6 != 0xf0 {
+		return frame, 0, errNoSync
+	}
+	headerLength := 7
+	if data[1] & 1 == 0 {
+		headerLength = 9
+	}
+	frame.ObjectType = int(data[2] >> 6) + 1
+	frame.SamplingIndex = int(data[2] >> 2 & 0x0f)
+	frame.ChannelConfig = int(data[2] & 1) << 2 | int(data[3] >> 6)
+	length := int(data[3] & 3) << 11 | int(data[4]) << 3 | int(data[5] >> 5)
+	if frame.SamplingIndex >= len(adtsSampleRates) || length < headerLength {
+		return frame, 0, errors.New("invalid ADTS header")
+	}
+	frame.SampleRate = adtsSampleRates[frame.SamplingIndex]
+	frame.Channels = frame.ChannelConfig
+	if frame.ChannelConfig == 7 {
+		frame.Channels = 8
+	}
+	frame.Samples = 1024 * (int(data[6] & 3) + 1)
+	frame.Header = data[:headerLength]
+	return frame, length, nil
+}
+
+// ParseADTS splits a PES payload into AAC frames. Bytes between frames that
+// do not start with a sync word are skipped.
+func ParseADTS(data []byte) ([]AudioFrame, error) {
+	var frames []AudioFrame
+	for i := 0; i + 7 <= len(data); {
+		frame, length, err := ParseADTSHeader(data[i:])
+		if err != nil {
+			i++
+			continue
+		}
+		if i + length > len(data) {
+			return frames, errors.New("truncated ADTS frame")
+		}
+		frame.Data = data[i + len(frame.Header):i + length]
+		frames = append(frames, frame)
+		i += length
+	}
+	if len(frames) == 0 && len(data) > 0 {
+		return nil, errNoSync
+	}
+	return frames, nil
+}
+
+var ac3SampleRates = []int{48000, 44100, 32000}
+
+// ac3FrameSizes holds the frame sizes in 16-bit words by sample rate and
+// frmsizecod.
+var ac3FrameSizes = [3][]int {
+	{64, 64, 80, 80, 96, 96, 112, 112, 128, 128, 160, 160, 192, 192, 224, 224, 256, 256,
+		320, 320, 384, 384, 448, 448, 512, 512, 640, 640, 768, 768, 896, 896, 1024, 1024,
+		1152, 1152, 1280, 1280},
+	{69, 70, 87, 88, 104, 105, 121, 122, 139, 140, 174, 175, 208, 209, 243, 244, 278, 279,
+		348, 349, 417, 418, 487, 488, 557, 558, 696, 697, 835, 836, 975, 976, 1114, 1115,
+		1253, 1254, 1393, 1394},
+	{96, 96, 120, 120, 144, 144, 168, 168, 192, 192, 240, 240, 288, 288, 336, 336, 384, 384,
+		480, 480, 576, 576, 672, 672, 768, 768, 960, 960, 1152, 1152, 1344, 1344, 1536, 1536,
+		1728, 1728, 1920, 1920},
+}
+
+var ac3Channels = []int{2, 1, 2, 3, 3, 4, 4, 5}
+
+// SyncFrameLength returns the length of the AC-3 or E-AC-3 sync frame at the
+// start of data, or 0 if there is none.
+func SyncFrameLength(data []byte) int {
+	if len(data) < 8 || data[0] != 0x0b || data[1] != 0x77 {
+		return 0
+	}
+	if data[5] >> 3 > 10 {
+		// E-AC-3 gives the frame size in 16-bit words.
+		return ((int(data[2] & 0x07) << 8 | int(data[3])) + 1) * 2
+	}
+	_, length, err := ParseAC3Header(data)
+	if err != nil {
+		return 0
+	}
+	return length
+}
+
+// ParseAC3Header parses the AC-3 sync frame header at the start of data and
+// returns the frame length.
+func ParseAC3Header(data []byte) (AudioFrame, int, error) {
+	var frame AudioFrame
+	if len(data) < 8 || data[0] != 0x0b || data[1] != 0x77 {
+		return frame, 0, errNoSync
+	}
+	fscod := int(data[4] >> 6)
+	frmsizecod := int(data[4] & 0x3f)
+	if fscod >= 3 || frmsizecod >= 38 {
+		return frame, 0, errors.New("invalid AC-3 header")
+	}
+	r := &bitReader{data: data[5:]}
+	bsid := r.bits(5)
+	bsmod := r.bits(3)
+	acmod := r.bits(3)
+	if acmod & 1 != 0 && acmod != 1 {
+		r.skip(2)
+	}
+	if acmod & 4 != 0 {
+		r.skip(2)
+	}
+	if acmod == 2 {
+		r.skip(2)
+	}
+	lfeon := r.bit()
+	if bsid > 8 {
+		return frame, 0, errors.New("unsupported AC-3 bitstream")
+	}
+	frame.SampleRate = ac3SampleRates[fscod]
+	frame.Channels = ac3Channels[acmod] + int(lfeon)
+	frame.Samples = 1536
+	frame.Header = data[:8]
+	// dac3: fscod(2) bsid(5) bsmod(3) acmod(3) lfeon(1) bit_rate_code(5)
+	// reserved(5)
+	config := uint32(fscod) << 22 | bsid << 17 | bsmod << 14 | acmod << 11 | lfeon << 10 |
+		uint32(frmsizecod / 2) << 5
+	frame.AC3Config = []byte{byte(config >> 16), byte(config >> 8), byte(config)}
+	return frame, ac3FrameSizes[fscod][frmsizecod] * 2, nil
+}
+
+// ParseAC3 splits a PES payload into AC-3 sync frames.
+func ParseAC3(data []byte) ([]AudioFrame, error) {
+	var frames []AudioFrame
+	for i := 0; i + 8 <= len(data); {
+		frame, length, err := ParseAC3Header(data[i:])
+		if err != nil {
+			i++
+			continue
+		}
+		if i + length > len(data) {
+			return frames, errors.New("truncated AC-3 frame")
+		}
+		frame.Data = data[i:i + length]
+		frames = append(frames, frame)
+		i += length
+	}
+	if len(frames) == 0 && len(data) > 0 {
+		return nil, errNoSync
+	}
+	return frames, nil
+}
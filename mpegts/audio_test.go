@@ -0,0 +1,87 @@
+package mpegts
+
+import (
+	"bytes"
+	"testing"
+)
+
+// adtsFrame returns an ADTS frame without CRC holding payload.
+func adtsFrame(objectType, samplingIndex, channelConfig int, payload []byte) []byte {
+	length := 7 + len(payload)
+	header := []byte {
+		0xff, 0xf1,
+		byte(objectType - 1) << 6 | byte(samplingIndex) << 2 | byte(channelConfig >> 2),
+		byte(channelConfig & 3) << 6 | byte(length >> 11),
+		byte(length >> 3),
+		byte(length & 7) << 5 | 0x1f,
+		0xfc,
+	}
+	return append(header, payload...)
+}
+
+func TestParseADTS(t *testing.T) {
+	lc := adtsFrame(2, 4, 2, []byte{1, 2, 3})
+	mainProfile := adtsFrame(1, 6, 1, []byte{4, 5})
+	tests := []struct {
+		name string
+		data []byte
+		frames [][]byte
+		sampleRates []int
+		channels []int
+		err bool
+	} {
+		{"single frame", lc, [][]byte{{1, 2, 3}}, []int{44100}, []int{2}, false},
+		{"two frames", append(append([]byte(nil), lc...), mainProfile...),
+			[][]byte{{1, 2, 3}, {4, 5}}, []int{44100, 24000}, []int{2, 1}, false},
+		{"garbage between frames", append(append(append([]byte(nil), lc...), 0, 0), mainProfile...),
+			[][]byte{{1, 2, 3}, {4, 5}}, []int{44100, 24000}, []int{2, 1}, false},
+		{"eight channels", adtsFrame(2, 3, 7, []byte{6}), [][]byte{{6}}, []int{48000}, []int{8}, false},
+		{"truncated frame", append(append([]byte(nil), lc...), mainProfile[:8]...),
+			[][]byte{{1, 2, 3}}, []int{44100}, []int{2}, true},
+		{"no sync", []byte{1, 2, 3, 4, 5, 6, 7, 8}, nil, nil, nil, true},
+		{"empty", nil, nil, nil, nil, false},
+	}
+	for _, test := range tests {
+		frames, err := ParseADTS(test.data)
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+		if len(frames) != len(test.frames) {
+			t.Errorf("%s: got %d frames, want %d", test.name, len(frames), len(test.frames))
+			continue
+		}
+		for i, frame := range frames {
+			if !bytes.Equal(frame.Data, test.frames[i]) {
+				t.Errorf("%s: frame %d is % x, want % x", test.name, i, frame.Data, test.frames[i])
+			}
+			if frame.SampleRate != test.sampleRates[i] || frame.Channels != test.channels[i] {
+				t.Errorf("%s: frame %d has %d Hz and %d channels, want %d Hz and %d channels", test.name, i,
+					frame.SampleRate, frame.Channels, test.sampleRates[i], test.channels[i])
+			}
+			if frame.Samples != 1024 {
+				t.Errorf("%s: frame %d has %d samples", test.name, i, frame.Samples)
+			}
+		}
+	}
+}
+
+func TestAudioSpecificConfig(t *testing.T) {
+	tests := []struct {
+		frame []byte
+		want []byte
+	} {
+		{adtsFrame(2, 4, 2, nil), []byte{0x12, 0x10}},
+		{adtsFrame(2, 3, 1, nil), []byte{0x11, 0x88}},
+		{adtsFrame(1, 6, 2, nil), []byte{0x0b, 0x10}},
+	}
+	for _, test := range tests {
+		frame, _, err := ParseADTSHeader(test.frame)
+		if err != nil {
+			t.Errorf("% x: %s", test.frame, err)
+			continue
+		}
+		if config := frame.AudioSpecificConfig(); !bytes.Equal(config, test.want) {
+			t.Errorf("% x: got % x, want % x", test.frame, config, test.want)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package mpegts
+
+import (
+	"errors"
+)
+
+const PacketSize = 188
+
+// Stream types of the PMT.
+const (
+	StreamTypeAAC = 0x0f
+	StreamTypePrivate = 0x06
+	StreamTypeH264 = 0x1b
+	StreamTypeH265 = 0x24
+	StreamTypeAC3 = 0x81
+)
+
+// Stream is an elementary stream announced in the PMT. Private streams
+// carrying AC-3 are reported as StreamTypeAC3.
+type Stream struct {
+	PID uint16
+	Type uint8
+}
+
+// PES is a reassembled PES packet. PTS and DTS are 33-bit timestamps in 90 kHz
+// units. DTS equals PTS if the packet carries no DTS.
+type PES struct {
+	PID uint16
+	StreamType uint8
+	PTS int64
+	DTS int64
+	HasPTS bool
+	Data []byte
+}
+
+type demuxer struct {
+	pmtPIDs map[uint16]bool
+	streams []Stream
+	streamTypes map[uint16]uint8
+	pending map[uint16][]byte
+	packets []*PES
+}
+
+// Sync returns the offset of the first packet of data.
+func Sync(data []byte) (int, error) {
+	for i := 0; i < len(data) && i < PacketSize; i++ {
+		if data[i] != 0x47 {
+			continue
+		}
+		if i + PacketSize < len(data) && data[i + PacketSize] != 0x47 {
+			continue
+		}
+		return i, nil
+	}
+	return 0, errors.New("no MPEG-TS sync byte")
+}
+
+// Demux splits a transport stream into the PES packets of the elementary
+// streams of its first program. The PAT and PMT are expected to fit in a
+// single packet each, which holds for HLS segments.
+func Demux(data []byte) ([]Stream, []*PES, error) {
+	start, err := Sync(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	d := &demuxer {
+		pmtPIDs: make(map[uint16]bool),
+		streamTypes: make(map[uint16]uint8),
+		pending: make(map[uint16][]byte),
+	}
+	for offset := start; offset + PacketSize <= len(data); offset += PacketSize {
+		packet := data[offset:offset + PacketSize]
+		if packet[0] != 0x47 {
+			return d.streams, d.packets, errors.New("lost MPEG-TS sync")
+		}
+		pid, unitStart, payload := parsePacket(packet)
+		if payload == nil {
+			continue
+		}
+		switch {
+		case pid == 0:
+			d.parsePAT(payload, unitStart)
+		case d.pmtPIDs[pid]:
+			d.parsePMT(payload, unitStart)
+		default:
+			if _, ok := d.streamTypes[pid]; !ok {
+				continue
+			}
+			if unitStart {
+				d.flush(pid)
+				d.pending[pid] = append([]byte(nil), payload...)
+			} else if d.pending[pid] != nil {
+				d.pending[pid] = append(d.pending[pid], payload...)
+			}
+		}
+	}
+	for _, stream := range d.streams {
+		d.flush(stream.PID)
+	}
+	return d.streams, d.packets, nil
+}
+
+// parsePacket returns the PID, payload unit start indicator and payload of a
+// packet.
+func parsePacket(packet []byte) (uint16, bool, []byte) {
+	pid := uint16(packet[1] & 0x1f) << 8 | uint16(packet[2])
+	unitStart := packet[1] & 0x40 != 0
+	adaptation := (packet[3] >> 4) & 3
+	offset := 4
+	if adaptation & 2 != 0 {
+		offset += 1 + int(packet[4])
+	}
+	if adaptation & 1 == 0 || offset >= PacketSize {
+		return pid, unitStart, nil
+	}
+	return pid, unitStart, packet[offset:]
+}
+
+// section returns the PSI section of a payload without its CRC.
+func section(payload []byte, unitStart bool) []byte {
+	if !unitStart || len(payload) < 1 {
+		return nil
+	}
+	pointer := int(payload[0])
+	if 1 + pointer + 3 > len(payload) {
+		return nil
+	}
+	payload = payload[1 + pointer:]
+	length := int(payload[1] & 0x0f) << 8 | int(payload[2])
+	if 3 + length > len(payload) || length < 9 {
+		return nil
+	}
+	return payload[:3 + length - 4]
+}
+
+func (d *demuxer) parsePAT(payload []byte, unitStart bool) {
+	s := section(payload, unitStart)
+	if s == nil || s[0] != 0x00 {
+		return
+	}
+	for i := 8; i + 4 <= len(s); i += 4 {
+		program := uint16(s[i]) << 8 | uint16(s[i + 1])
+		pid := uint16(s[i + 2] & 0x1f) << 8 | uint16(s[i + 3])
+		if program != 0 {
+			d.pmtPIDs[pid] = true
+			return
+		}
+	}
+}
+
+func (d *demuxer) parsePMT(payload []byte, unitStart bool) {
+	s := section(payload, unitStart)
+	if s == nil || s[0] != 0x02 || len(s) < 12 {
+		return
+	}
+	infoLength := int(s[10] & 0x0f) << 8 | int(s[11])
+	for i := 12 + infoLength; i + 5 <= len(s); {
+		streamType := s[i]
+		pid := uint16(s[i + 1] & 0x1f) << 8 | uint16(s[i + 2])
+		esInfoLength := int(s[i + 3] & 0x0f) << 8 | int(s[i + 4])
+		end := i + 5 + esInfoLength
+		if end > len(s) {
+			return
+		}
+		if streamType == StreamTypePrivate && hasAC3Descriptor(s[i + 5:end]) {
+			streamType = StreamTypeAC3
+		}
+		if _, ok := d.streamTypes[pid]; !ok {
+			d.streamTypes[pid] = streamType
+			d.streams = append(d.streams, Stream{pid, streamType})
+		}
+		i = end
+	}
+}
+
+// hasAC3Descriptor looks for the DVB AC-3 descriptor or an "AC-3"
+// registration descriptor.
+func hasAC3Descriptor(descriptors []byte) bool {
+	for i := 0; i + 2 <= len(descriptors); {
+		tag := descriptors[i]
+		length := int(descriptors[i + 1])
+		if i + 2 + length > len(descriptors) {
+			return false
+		}
+		if tag == 0x6a {
+			return true
+		}
+		if tag == 0x05 && length >= 4 && string(descriptors[i + 2:i + 6]) == "AC-3" {
+			return true
+		}
+		i += 2 + length
+	}
+	return false
+}
+
+func readTimestamp(b []byte) int64 {
+	return int64(b[0] >> 1 & 0x07) << 30 | int64(b[1]) << 22 | int64(b[2] >> 1) << 15 |
+		int64(b[3]) << 7 | int64(b[4] >> 1)
+}
+
+func (d *demuxer) flush(pid uint16) {
+	data := d.pending[pid]
+	delete(d.pending, pid)
+	if len(data) < 9 || data[0] != 0 || data[1] != 0 || data[2] != 1 {
+		return
+	}
+	pes := &PES {
+		PID: pid,
+		StreamType: d.streamTypes[pid],
+	}
+	headerLength := int(data[8])
+	if 9 + headerLength > len(data) {
+		return
+	}
+	flags := data[7] >> 6
+	if flags & 2 != 0 && headerLength >= 5 {
+		pes.PTS = readTimestamp(data[9:14])
+		pes.DTS = pes.PTS
+		pes.HasPTS = true
+	}
+	if flags == 3 && headerLength >= 10 {
+		pes.DTS = readTimestamp(data[14:19])
+	}
+	pes.Data = data[9 + headerLength:]
+	// PES_packet_length is usually 0 for video. Otherwise it bounds the
+	// payload.
+	length := int(data[4]) << 8 | int(data[5])
+	if length > 0 && 6 + length < len(data) && 6 + length >= 9 + headerLength {
+		pes.Data = data[9 + headerLength:6 + length]
+	}
+	d.packets = append(d.packets, pes)
+}
@@ -0,0 +1,155 @@
+package mpegts
+
+import (
+	"bytes"
+	"testing"
+)
+
+// tsPackets splits payload into transport stream packets of pid, stuffing
+// the adaptation field of the last one.
+func tsPackets(pid uint16, payload []byte) []byte {
+	var data []byte
+	for first := true; first || len(payload) > 0; first = false {
+		packet := []byte{0x47, byte(pid >> 8), byte(pid), 0x10}
+		if first {
+			packet[1] |= 0x40
+		}
+		n := len(payload)
+		if n > PacketSize - 4 {
+			n = PacketSize - 4
+		}
+		if stuffing := PacketSize - 4 - n; stuffing > 0 {
+			packet[3] = 0x30
+			packet = append(packet, byte(stuffing - 1))
+			if stuffing > 1 {
+				packet = append(packet, 0)
+				packet = append(packet, bytes.Repeat([]byte{0xff}, stuffing - 2)...)
+			}
+		}
+		packet = append(packet, payload[:n]...)
+		payload = payload[n:]
+		data = append(data, packet...)
+	}
+	return data
+}
+
+// psi wraps a section with its pointer field, length and a dummy CRC.
+func psi(tableID byte, body []byte) []byte {
+	length := len(body) + 4
+	section := []byte{0, tableID, 0xb0 | byte(length >> 8), byte(length)}
+	section = append(section, body...)
+	return append(section, 0, 0, 0, 0)
+}
+
+// programTables returns the PAT and a PMT with the given stream types, on
+// PIDs 0x100 and up.
+func programTables(streamTypes ...byte) []byte {
+	pat := psi(0x00, []byte{0, 1, 0xc1, 0, 0, 0, 1, 0xe0, 0x20})
+	pmt := []byte{0, 1, 0xc1, 0, 0, 0xe1, 0x00, 0xf0, 0}
+	for i, streamType := range streamTypes {
+		pmt = append(pmt, streamType, 0xe1, byte(i), 0xf0, 0)
+	}
+	data := tsPackets(0, pat)
+	return append(data, tsPackets(0x20, psi(0x02, pmt))...)
+}
+
+func timestamp(prefix byte, ts int64) []byte {
+	return []byte {
+		prefix << 4 | byte(ts >> 29) & 0x0e | 1,
+		byte(ts >> 22),
+		byte(ts >> 14) | 1,
+		byte(ts >> 7),
+		byte(ts << 1) | 1,
+	}
+}
+
+// pes returns a PES packet. dts is left out if it is -1, and pts too if it
+// is -1.
+func pes(pts, dts int64, length int, data []byte) []byte {
+	var header []byte
+	flags := byte(0)
+	if pts != -1 && dts != -1 {
+		flags = 0xc0
+		header = append(timestamp(3, pts), timestamp(1, dts)...)
+	} else if pts != -1 {
+		flags = 0x80
+		header = timestamp(2, pts)
+	}
+	b := []byte{0, 0, 1, 0xe0, byte(length >> 8), byte(length), 0x80, flags, byte(len(header))}
+	b = append(b, header...)
+	return append(b, data...)
+}
+
+func TestDemux(t *testing.T) {
+	long := bytes.Repeat([]byte{0xab}, 500)
+	tests := []struct {
+		name string
+		pes []byte
+		hasPTS bool
+		pts int64
+		dts int64
+		data []byte
+	} {
+		{"pts", pes(900000, -1, 0, []byte{1, 2, 3}), true, 900000, 900000, []byte{1, 2, 3}},
+		{"pts and dts", pes(903000, 900000, 0, []byte{4}), true, 903000, 900000, []byte{4}},
+		{"33-bit pts", pes(1 << 32 + 5, -1, 0, []byte{5}), true, 1 << 32 + 5, 1 << 32 + 5, []byte{5}},
+		{"no pts", pes(-1, -1, 0, []byte{6}), false, 0, 0, []byte{6}},
+		{"several packets", pes(90000, -1, 0, long), true, 90000, 90000, long},
+		{"packet length", pes(90000, -1, 3 + 5 + 2, long), true, 90000, 90000, long[:2]},
+	}
+	for _, test := range tests {
+		data := append(programTables(StreamTypeH264), tsPackets(0x100, test.pes)...)
+		streams, packets, err := Demux(data)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if len(streams) != 1 || streams[0] != (Stream{0x100, StreamTypeH264}) {
+			t.Errorf("%s: got streams %v", test.name, streams)
+		}
+		if len(packets) != 1 {
+			t.Errorf("%s: got %d packets", test.name, len(packets))
+			continue
+		}
+		p := packets[0]
+		if p.HasPTS != test.hasPTS || p.PTS != test.pts || p.DTS != test.dts {
+			t.Errorf("%s: got pts %d dts %d (%t), want %d %d (%t)", test.name,
+				p.PTS, p.DTS, p.HasPTS, test.pts, test.dts, test.hasPTS)
+		}
+		if !bytes.Equal(p.Data, test.data) {
+			t.Errorf("%s: got % x, want % x", test.name, p.Data, test.data)
+		}
+	}
+}
+
+func TestDemuxStreams(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		streams []Stream
+		err bool
+	} {
+		{"video and audio", programTables(StreamTypeH264, StreamTypeAAC),
+			[]Stream{{0x100, StreamTypeH264}, {0x101, StreamTypeAAC}}, false},
+		{"leading garbage", append([]byte{1, 2, 3}, programTables(StreamTypeH265)...),
+			[]Stream{{0x100, StreamTypeH265}}, false},
+		{"no sync", bytes.Repeat([]byte{0}, 2 * PacketSize), nil, true},
+		{"lost sync", append(programTables(StreamTypeH264), make([]byte, PacketSize)...),
+			[]Stream{{0x100, StreamTypeH264}}, true},
+	}
+	for _, test := range tests {
+		streams, _, err := Demux(test.data)
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+		if len(streams) != len(test.streams) {
+			t.Errorf("%s: got streams %v, want %v", test.name, streams, test.streams)
+			continue
+		}
+		for i := range streams {
+			if streams[i] != test.streams[i] {
+				t.Errorf("%s: got streams %v, want %v", test.name, streams, test.streams)
+			}
+		}
+	}
+}
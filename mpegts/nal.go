@@ -0,0 +1,334 @@
+package mpegts
+
+import (
+	"errors"
+)
+
+// H.264 NAL unit types.
+const (
+	H264NALSlice = 1
+	H264NALIDR = 5
+	H264NALSPS = 7
+	H264NALPPS = 8
+	H264NALAUD = 9
+)
+
+// H.265 NAL unit types.
+const (
+	H265NALVPS = 32
+	H265NALSPS = 33
+	H265NALPPS = 34
+	H265NALAUD = 35
+)
+
+func H264NALType(nal []byte) int {
+	return int(nal[0] & 0x1f)
+}
+
+func H265NALType(nal []byte) int {
+	return int(nal[0] >> 1 & 0x3f)
+}
+
+// H265IsIRAP reports whether a NAL unit type is a random access point.
+func H265IsIRAP(nalType int) bool {
+	return nalType >= 16 && nalType <= 23
+}
+
+// SplitNALUnits splits an Annex B byte stream at its start codes.
+func SplitNALUnits(data []byte) [][]byte {
+	var nals [][]byte
+	for _, r := range nalUnitRanges(data) {
+		nals = append(nals, data[r[0]:r[1]])
+	}
+	return nals
+}
+
+// nalUnitRanges returns the start and end offsets of the NAL units of an
+// Annex B byte stream.
+func nalUnitRanges(data []byte) [][2]int {
+	var ranges [][2]int
+	start := -1
+	zeros := 0
+	for i := 0; i < len(data); i++ {
+		if data[i] == 0 {
+			zeros++
+			continue
+		}
+		if data[i] == 1 && zeros >= 2 {
+			if start != -1 {
+				end := i - zeros
+				if end > start {
+					ranges = append(ranges, [2]int{start, end})
+				}
+			}
+			start = i + 1
+		}
+		zeros = 0
+	}
+	if start != -1 && start < len(data) {
+		end := len(data)
+		for end > start && data[end - 1] == 0 {
+			end--
+		}
+		ranges = append(ranges, [2]int{start, end})
+	}
+	return ranges
+}
+
+// RemoveEmulationPrevention turns a NAL unit into its RBSP.
+func RemoveEmulationPrevention(nal []byte) []byte {
+	rbsp := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
+
+// AddEmulationPrevention turns an RBSP into a NAL unit.
+func AddEmulationPrevention(rbsp []byte) []byte {
+	nal := make([]byte, 0, len(rbsp) + len(rbsp) / 64)
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 3 {
+			nal = append(nal, 3)
+			zeros = 0
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		nal = append(nal, b)
+	}
+	if len(nal) > 0 && nal[len(nal) - 1] == 0 {
+		nal = append(nal, 3)
+	}
+	return nal
+}
+
+var errShortRBSP = errors.New("parameter set is truncated")
+
+type bitReader struct {
+	data []byte
+	pos int
+	err error
+}
+
+func (r *bitReader) bit() uint32 {
+	if r.pos >= len(r.data) * 8 {
+		r.err = errShortRBSP
+		return 0
+	}
+	b := r.data[r.pos / 8] >> (7 - r.pos % 8) & 1
+	r.pos++
+	return uint32(b)
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		v = v << 1 | r.bit()
+	}
+	return v
+}
+
+func (r *bitReader) skip(n int) {
+	r.pos += n
+}
+
+// ue reads an unsigned Exp-Golomb code.
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for r.bit() == 0 {
+		if r.err != nil || zeros > 31 {
+			r.err = errShortRBSP
+			return 0
+		}
+		zeros++
+	}
+	return (1 << zeros) - 1 + r.bits(zeros)
+}
+
+// se reads a signed Exp-Golomb code.
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v & 1 != 0 {
+		return int32(v + 1) / 2
+	}
+	return -int32(v / 2)
+}
+
+// SPS holds what a muxer needs from a sequence parameter set.
+type SPS struct {
+	Width int
+	Height int
+	ChromaFormat int
+	BitDepthLuma int
+	BitDepthChroma int
+	// H.265 only.
+	ProfileTierLevel []byte
+	MaxSubLayers int
+	TemporalIdNesting bool
+}
+
+func croppedSize(width, height, chromaFormat int, left, right, top, bottom uint32, frameMbsOnly bool) (int, int) {
+	cropX := 1
+	cropY := 1
+	if chromaFormat == 1 || chromaFormat == 2 {
+		cropX = 2
+	}
+	if chromaFormat == 1 {
+		cropY = 2
+	}
+	if !frameMbsOnly {
+		cropY *= 2
+	}
+	return width - cropX * int(left + right), height - cropY * int(top + bottom)
+}
+
+// ParseH264SPS parses an H.264 SPS NAL unit.
+func ParseH264SPS(nal []byte) (SPS, error) {
+	sps := SPS {
+		ChromaFormat: 1,
+		BitDepthLuma: 8,
+		BitDepthChroma: 8,
+	}
+	r := &bitReader{data: RemoveEmulationPrevention(nal)}
+	r.skip(8)
+	profile := r.bits(8)
+	r.skip(16)
+	r.ue()
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		sps.ChromaFormat = int(r.ue())
+		if sps.ChromaFormat == 3 {
+			r.skip(1)
+		}
+		sps.BitDepthLuma = int(r.ue()) + 8
+		sps.BitDepthChroma = int(r.ue()) + 8
+		r.skip(1)
+		if r.bit() == 1 {
+			lists := 8
+			if sps.ChromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.bit() == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last := int32(8)
+				next := int32(8)
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	r.ue()
+	switch r.ue() {
+	case 0:
+		r.ue()
+	case 1:
+		r.skip(1)
+		r.se()
+		r.se()
+		n := r.ue()
+		for i := uint32(0); i < n && r.err == nil; i++ {
+			r.se()
+		}
+	}
+	r.ue()
+	r.skip(1)
+	widthMbs := int(r.ue()) + 1
+	heightUnits := int(r.ue()) + 1
+	frameMbsOnly := r.bit() == 1
+	if !frameMbsOnly {
+		r.skip(1)
+	}
+	r.skip(1)
+	var left, right, top, bottom uint32
+	if r.bit() == 1 {
+		left, right, top, bottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+	if r.err != nil {
+		return sps, r.err
+	}
+	height := heightUnits * 16
+	if !frameMbsOnly {
+		height *= 2
+	}
+	sps.Width, sps.Height = croppedSize(widthMbs * 16, height, sps.ChromaFormat,
+		left, right, top, bottom, frameMbsOnly)
+	return sps, nil
+}
+
+// ParseH265SPS parses an H.265 SPS NAL unit.
+func ParseH265SPS(nal []byte) (SPS, error) {
+	var sps SPS
+	rbsp := RemoveEmulationPrevention(nal)
+	if len(rbsp) < 15 {
+		return sps, errShortRBSP
+	}
+	r := &bitReader{data: rbsp}
+	r.skip(16 + 4)
+	sps.MaxSubLayers = int(r.bits(3)) + 1
+	sps.TemporalIdNesting = r.bit() == 1
+	sps.ProfileTierLevel = append([]byte(nil), rbsp[3:15]...)
+	r.skip(96)
+	subLayers := sps.MaxSubLayers - 1
+	profilePresent := make([]bool, subLayers)
+	levelPresent := make([]bool, subLayers)
+	for i := 0; i < subLayers; i++ {
+		profilePresent[i] = r.bit() == 1
+		levelPresent[i] = r.bit() == 1
+	}
+	if subLayers > 0 {
+		r.skip(2 * (8 - subLayers))
+	}
+	for i := 0; i < subLayers; i++ {
+		if profilePresent[i] {
+			r.skip(88)
+		}
+		if levelPresent[i] {
+			r.skip(8)
+		}
+	}
+	r.ue()
+	sps.ChromaFormat = int(r.ue())
+	if sps.ChromaFormat == 3 {
+		r.skip(1)
+	}
+	width := int(r.ue())
+	height := int(r.ue())
+	var left, right, top, bottom uint32
+	if r.bit() == 1 {
+		left, right, top, bottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+	sps.BitDepthLuma = int(r.ue()) + 8
+	sps.BitDepthChroma = int(r.ue()) + 8
+	if r.err != nil {
+		return sps, r.err
+	}
+	sps.Width, sps.Height = croppedSize(width, height, sps.ChromaFormat,
+		left, right, top, bottom, true)
+	return sps, nil
+}
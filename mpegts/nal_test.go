@@ -0,0 +1,241 @@
+package mpegts
+
+import (
+	"bytes"
+	"testing"
+)
+
+// bitWriter builds RBSPs for the SPS tests.
+type bitWriter struct {
+	data []byte
+	n int
+}
+
+func (w *bitWriter) bits(n int, v uint32) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n % 8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		w.data[len(w.data) - 1] |= byte(v >> i & 1) << (7 - w.n % 8)
+		w.n++
+	}
+}
+
+func (w *bitWriter) ue(v uint32) {
+	v++
+	length := 0
+	for x := v; x > 1; x >>= 1 {
+		length++
+	}
+	w.bits(length, 0)
+	w.bits(length + 1, v)
+}
+
+// nal adds the stop bit and emulation prevention.
+func (w *bitWriter) nal() []byte {
+	w.bits(1, 1)
+	return AddEmulationPrevention(w.data)
+}
+
+// h264SPS returns an SPS without VUI. Cropping is left out if crop is nil.
+func h264SPS(profile uint32, widthMbs, heightMbs uint32, crop []uint32) []byte {
+	w := &bitWriter{}
+	w.bits(8, 0x67)
+	w.bits(8, profile)
+	w.bits(16, 30)
+	w.ue(0)
+	if profile == 100 {
+		w.ue(1)
+		w.ue(0)
+		w.ue(0)
+		w.bits(2, 0)
+	}
+	w.ue(0)
+	w.ue(2)
+	w.ue(1)
+	w.bits(1, 0)
+	w.ue(widthMbs - 1)
+	w.ue(heightMbs - 1)
+	w.bits(2, 3)
+	w.bits(1, uint32(len(crop) / 4))
+	for _, v := range crop {
+		w.ue(v)
+	}
+	w.bits(1, 0)
+	return w.nal()
+}
+
+// h265SPS returns an SPS of a single sub-layer.
+func h265SPS(width, height uint32, bitDepth uint32) []byte {
+	w := &bitWriter{}
+	w.bits(16, 0x4201)
+	w.bits(4, 0)
+	w.bits(3, 0)
+	w.bits(1, 1)
+	w.bits(8, 0x01)
+	w.bits(32, 0x60000000)
+	w.bits(16, 0x9000)
+	w.bits(32, 0)
+	w.bits(8, 93)
+	w.ue(0)
+	w.ue(1)
+	w.ue(width)
+	w.ue(height)
+	w.bits(1, 0)
+	w.ue(bitDepth - 8)
+	w.ue(bitDepth - 8)
+	return w.nal()
+}
+
+func TestSplitNALUnits(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want [][]byte
+	} {
+		{"four-byte start codes", []byte{0, 0, 0, 1, 9, 0xf0, 0, 0, 0, 1, 0x65, 1},
+			[][]byte{{9, 0xf0}, {0x65, 1}}},
+		{"three-byte start codes", []byte{0, 0, 1, 0x67, 2, 0, 0, 1, 0x68, 3},
+			[][]byte{{0x67, 2}, {0x68, 3}}},
+		{"trailing zeros", []byte{0, 0, 1, 0x41, 4, 0, 0, 0, 0, 0, 1, 0x41, 5, 0, 0},
+			[][]byte{{0x41, 4}, {0x41, 5}}},
+		{"leading garbage", []byte{7, 7, 0, 0, 1, 0x41, 6}, [][]byte{{0x41, 6}}},
+		{"empty unit", []byte{0, 0, 1, 0, 0, 1, 0x41}, [][]byte{{0x41}}},
+		{"no start code", []byte{0x41, 1, 2}, nil},
+	}
+	for _, test := range tests {
+		nals := SplitNALUnits(test.data)
+		if len(nals) != len(test.want) {
+			t.Errorf("%s: got % x, want % x", test.name, nals, test.want)
+			continue
+		}
+		for i := range nals {
+			if !bytes.Equal(nals[i], test.want[i]) {
+				t.Errorf("%s: got % x, want % x", test.name, nals, test.want)
+			}
+		}
+	}
+}
+
+func TestEmulationPrevention(t *testing.T) {
+	tests := []struct {
+		rbsp []byte
+		nal []byte
+	} {
+		{[]byte{1, 2, 3}, []byte{1, 2, 3}},
+		{[]byte{0, 0, 0, 1}, []byte{0, 0, 3, 0, 1}},
+		{[]byte{0, 0, 1}, []byte{0, 0, 3, 1}},
+		{[]byte{0, 0, 3}, []byte{0, 0, 3, 3}},
+		{[]byte{0, 0, 4}, []byte{0, 0, 4}},
+		{[]byte{0, 0, 0, 0, 0, 5}, []byte{0, 0, 3, 0, 0, 3, 0, 5}},
+	}
+	for _, test := range tests {
+		if nal := AddEmulationPrevention(test.rbsp); !bytes.Equal(nal, test.nal) {
+			t.Errorf("% x: got % x, want % x", test.rbsp, nal, test.nal)
+		}
+		if rbsp := RemoveEmulationPrevention(test.nal); !bytes.Equal(rbsp, test.rbsp) {
+			t.Errorf("% x: got % x, want % x", test.nal, rbsp, test.rbsp)
+		}
+	}
+	// NAL units can not end with a zero byte.
+	if nal := AddEmulationPrevention([]byte{1, 0}); !bytes.Equal(nal, []byte{1, 0, 3}) {
+		t.Errorf("01 00: got % x, want 01 00 03", nal)
+	}
+}
+
+func TestNALTypes(t *testing.T) {
+	tests := []struct {
+		nal []byte
+		h264 int
+		h265 int
+	} {
+		{[]byte{0x67}, H264NALSPS, 51},
+		{[]byte{0x65}, H264NALIDR, 50},
+		{[]byte{0x09}, H264NALAUD, 4},
+		{[]byte{0x40, 0x01}, 0, H265NALVPS},
+		{[]byte{0x42, 0x01}, 2, H265NALSPS},
+		{[]byte{0x46, 0x01}, 6, H265NALAUD},
+		{[]byte{0x26, 0x01}, 6, 19},
+	}
+	for _, test := range tests {
+		if nalType := H264NALType(test.nal); nalType != test.h264 {
+			t.Errorf("% x: got H.264 type %d, want %d", test.nal, nalType, test.h264)
+		}
+		if nalType := H265NALType(test.nal); nalType != test.h265 {
+			t.Errorf("% x: got H.265 type %d, want %d", test.nal, nalType, test.h265)
+		}
+	}
+	for nalType := 0; nalType < 64; nalType++ {
+		if irap := H265IsIRAP(nalType); irap != (nalType >= 16 && nalType <= 23) {
+			t.Errorf("H.265 type %d: got IRAP %t", nalType, irap)
+		}
+	}
+}
+
+func TestParseH264SPS(t *testing.T) {
+	tests := []struct {
+		name string
+		nal []byte
+		width int
+		height int
+		chromaFormat int
+	} {
+		{"baseline 720p", h264SPS(66, 80, 45, nil), 1280, 720, 1},
+		{"cropped 1080p", h264SPS(66, 120, 68, []uint32{0, 0, 0, 4}), 1920, 1080, 1},
+		{"high profile", h264SPS(100, 40, 30, []uint32{1, 1, 0, 0}), 636, 480, 1},
+	}
+	for _, test := range tests {
+		sps, err := ParseH264SPS(test.nal)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if sps.Width != test.width || sps.Height != test.height {
+			t.Errorf("%s: got %dx%d, want %dx%d", test.name, sps.Width, sps.Height, test.width, test.height)
+		}
+		if sps.ChromaFormat != test.chromaFormat || sps.BitDepthLuma != 8 || sps.BitDepthChroma != 8 {
+			t.Errorf("%s: got chroma format %d and bit depths %d/%d", test.name,
+				sps.ChromaFormat, sps.BitDepthLuma, sps.BitDepthChroma)
+		}
+	}
+	if _, err := ParseH264SPS([]byte{0x67, 66}); err == nil {
+		t.Errorf("truncated SPS: no error")
+	}
+}
+
+func TestParseH265SPS(t *testing.T) {
+	tests := []struct {
+		name string
+		nal []byte
+		width int
+		height int
+		bitDepth int
+	} {
+		{"1080p", h265SPS(1920, 1080, 8), 1920, 1080, 8},
+		{"10-bit 4K", h265SPS(3840, 2160, 10), 3840, 2160, 10},
+	}
+	for _, test := range tests {
+		sps, err := ParseH265SPS(test.nal)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if sps.Width != test.width || sps.Height != test.height {
+			t.Errorf("%s: got %dx%d, want %dx%d", test.name, sps.Width, sps.Height, test.width, test.height)
+		}
+		if sps.BitDepthLuma != test.bitDepth || sps.BitDepthChroma != test.bitDepth {
+			t.Errorf("%s: got bit depths %d/%d", test.name, sps.BitDepthLuma, sps.BitDepthChroma)
+		}
+		if sps.MaxSubLayers != 1 || !sps.TemporalIdNesting || sps.ChromaFormat != 1 {
+			t.Errorf("%s: got %d sub-layers, nesting %t, chroma format %d", test.name,
+				sps.MaxSubLayers, sps.TemporalIdNesting, sps.ChromaFormat)
+		}
+		ptl := []byte{0x01, 0x60, 0, 0, 0, 0x90, 0, 0, 0, 0, 0, 93}
+		if !bytes.Equal(sps.ProfileTierLevel, ptl) {
+			t.Errorf("%s: got profile_tier_level % x", test.name, sps.ProfileTierLevel)
+		}
+	}
+	if _, err := ParseH265SPS([]byte{0x42, 0x01, 0x01}); err == nil {
+		t.Errorf("truncated SPS: no error")
+	}
+}
@@ -0,0 +1,389 @@
+package mpegts
+
+import (
+	"errors"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+)
+
+// Stream types of SAMPLE-AES encrypted streams, as defined by Apple's MPEG-2
+// Stream Encryption Format for HTTP Live Streaming.
+const (
+	StreamTypeEAC3 = 0x87
+	StreamTypeH264Encrypted = 0xdb
+	StreamTypeAACEncrypted = 0xcf
+	StreamTypeAC3Encrypted = 0xc1
+	StreamTypeEAC3Encrypted = 0xc2
+)
+
+var clearStreamTypes = map[uint8]uint8 {
+	StreamTypeH264Encrypted: StreamTypeH264,
+	StreamTypeAACEncrypted: StreamTypeAAC,
+	StreamTypeAC3Encrypted: StreamTypeAC3,
+	StreamTypeEAC3Encrypted: StreamTypeEAC3,
+}
+
+type sampleAESDecrypter struct {
+	demuxer
+	block cipher.Block
+	iv []byte
+	// types holds the encrypted stream type of each encrypted PID.
+	types map[uint16]uint8
+	pids []uint16
+	// pending holds the indices in packets of the PES packet being collected
+	// for each PID.
+	pending map[uint16][]int
+	// packets usually holds one packet per entry. Entries of PES packets that
+	// grew hold additional packets, those of packets that are no longer
+	// needed are nil.
+	packets [][]byte
+}
+
+// DecryptSampleAES decrypts a transport stream encrypted with SAMPLE-AES. The
+// PMT is changed to announce the clear stream types. Decrypted H.264 NAL
+// units may differ in size once emulation prevention bytes are inserted, so
+// the PES packets are put back into the packets they came from, with packets
+// added or stuffed as needed.
+func DecryptSampleAES(data, key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid IV length")
+	}
+	start, err := Sync(data)
+	if err != nil {
+		return nil, err
+	}
+	d := &sampleAESDecrypter {
+		demuxer: demuxer {
+			pmtPIDs: make(map[uint16]bool),
+		},
+		block: block,
+		iv: iv,
+		types: make(map[uint16]uint8),
+		pending: make(map[uint16][]int),
+	}
+	offset := start
+	for ; offset + PacketSize <= len(data); offset += PacketSize {
+		packet := append([]byte(nil), data[offset:offset + PacketSize]...)
+		if packet[0] != 0x47 {
+			return nil, errors.New("lost MPEG-TS sync")
+		}
+		d.packets = append(d.packets, packet)
+		pid, unitStart, payload := parsePacket(packet)
+		if payload == nil {
+			continue
+		}
+		switch {
+		case pid == 0:
+			d.parsePAT(payload, unitStart)
+		case d.pmtPIDs[pid]:
+			d.rewritePMT(payload, unitStart)
+		default:
+			if _, ok := d.types[pid]; !ok {
+				continue
+			}
+			if unitStart {
+				d.flush(pid)
+				d.pending[pid] = []int{len(d.packets) - 1}
+			} else if d.pending[pid] != nil {
+				d.pending[pid] = append(d.pending[pid], len(d.packets) - 1)
+			}
+		}
+	}
+	for _, pid := range d.pids {
+		d.flush(pid)
+	}
+	d.renumber()
+	var result []byte
+	for _, packet := range d.packets {
+		result = append(result, packet...)
+	}
+	return append(result, data[offset:]...), nil
+}
+
+// crc32MPEG is the CRC of PSI sections.
+func crc32MPEG(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc & 0x80000000 != 0 {
+				crc = crc << 1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// rewritePMT replaces the encrypted stream types of a PMT in place. The
+// descriptors telling about the encryption are kept, players ignore them.
+func (d *sampleAESDecrypter) rewritePMT(payload []byte, unitStart bool) {
+	s := section(payload, unitStart)
+	if s == nil || s[0] != 0x02 || len(s) < 12 {
+		return
+	}
+	changed := false
+	infoLength := int(s[10] & 0x0f) << 8 | int(s[11])
+	for i := 12 + infoLength; i + 5 <= len(s); {
+		pid := uint16(s[i + 1] & 0x1f) << 8 | uint16(s[i + 2])
+		esInfoLength := int(s[i + 3] & 0x0f) << 8 | int(s[i + 4])
+		if clear, ok := clearStreamTypes[s[i]]; ok {
+			if _, ok := d.types[pid]; !ok {
+				d.pids = append(d.pids, pid)
+			}
+			d.types[pid] = s[i]
+			s[i] = clear
+			changed = true
+		}
+		i += 5 + esInfoLength
+	}
+	if changed {
+		// section leaves out the CRC, which follows it in payload.
+		crc := s[len(s):len(s) + 4]
+		binary.BigEndian.PutUint32(crc, crc32MPEG(s))
+	}
+}
+
+func (d *sampleAESDecrypter) flush(pid uint16) {
+	slots := d.pending[pid]
+	delete(d.pending, pid)
+	if len(slots) == 0 {
+		return
+	}
+	var pes []byte
+	for _, i := range slots {
+		_, _, payload := parsePacket(d.packets[i])
+		pes = append(pes, payload...)
+	}
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return
+	}
+	headerLength := 9 + int(pes[8])
+	if headerLength > len(pes) {
+		return
+	}
+	end := len(pes)
+	length := int(pes[4]) << 8 | int(pes[5])
+	if length > 0 && 6 + length < len(pes) && 6 + length >= headerLength {
+		end = 6 + length
+	}
+	es := append([]byte(nil), pes[headerLength:end]...)
+	switch d.types[pid] {
+	case StreamTypeH264Encrypted:
+		es = d.decryptH264(es)
+	case StreamTypeAACEncrypted:
+		d.decryptADTS(es)
+	case StreamTypeAC3Encrypted, StreamTypeEAC3Encrypted:
+		d.decryptAC3(es)
+	}
+	result := append(append([]byte(nil), pes[:headerLength]...), es...)
+	result = append(result, pes[end:]...)
+	if length > 0 {
+		length = headerLength - 6 + len(es)
+		if length > 0xffff {
+			length = 0
+		}
+		binary.BigEndian.PutUint16(result[4:], uint16(length))
+	}
+	d.distribute(slots, result)
+}
+
+// decryptBlocks decrypts the whole blocks of data after a clear leader of 16
+// bytes, which is how audio frames are encrypted.
+func (d *sampleAESDecrypter) decryptBlocks(data []byte) {
+	if len(data) < 32 {
+		return
+	}
+	encrypted := data[16:16 + (len(data) - 16) / aes.BlockSize * aes.BlockSize]
+	cipher.NewCBCDecrypter(d.block, d.iv).CryptBlocks(encrypted, encrypted)
+}
+
+// decryptH264 decrypts the slices of an Annex B byte stream. Of slices longer
+// than 48 bytes, the first 32 bytes are clear, followed by one encrypted
+// block of every ten. A last block of 16 bytes or less is clear. Emulation
+// prevention bytes were inserted after encryption.
+func (d *sampleAESDecrypter) decryptH264(es []byte) []byte {
+	var result []byte
+	copied := 0
+	for _, r := range nalUnitRanges(es) {
+		nal := es[r[0]:r[1]]
+		nalType := H264NALType(nal)
+		if nalType != H264NALSlice && nalType != H264NALIDR {
+			continue
+		}
+		rbsp := RemoveEmulationPrevention(nal)
+		if len(rbsp) <= 48 {
+			continue
+		}
+		mode := cipher.NewCBCDecrypter(d.block, d.iv)
+		for i := 32; len(rbsp) - i > aes.BlockSize; i += 10 * aes.BlockSize {
+			mode.CryptBlocks(rbsp[i:i + aes.BlockSize], rbsp[i:i + aes.BlockSize])
+		}
+		result = append(result, es[copied:r[0]]...)
+		result = append(result, AddEmulationPrevention(rbsp)...)
+		copied = r[1]
+	}
+	return append(result, es[copied:]...)
+}
+
+// decryptADTS decrypts the AAC frames of a PES payload in place. The ADTS
+// header is clear.
+func (d *sampleAESDecrypter) decryptADTS(es []byte) {
+	for i := 0; i + 7 <= len(es); {
+		frame, length, err := ParseADTSHeader(es[i:])
+		if err != nil {
+			i++
+			continue
+		}
+		if i + length > len(es) {
+			return
+		}
+		d.decryptBlocks(es[i + len(frame.Header):i + length])
+		i += length
+	}
+}
+
+// decryptAC3 decrypts the AC-3 or E-AC-3 sync frames of a PES payload in
+// place.
+func (d *sampleAESDecrypter) decryptAC3(es []byte) {
+	for i := 0; i + 8 <= len(es); {
+		length := SyncFrameLength(es[i:])
+		if length == 0 {
+			i++
+			continue
+		}
+		if i + length > len(es) {
+			return
+		}
+		d.decryptBlocks(es[i:i + length])
+		i += length
+	}
+}
+
+// distribute puts a PES packet back into the packets it was read from.
+func (d *sampleAESDecrypter) distribute(slots []int, pes []byte) {
+	for _, i := range slots {
+		packet := d.packets[i]
+		_, _, payload := parsePacket(packet)
+		n := len(payload)
+		if n > len(pes) {
+			n = len(pes)
+		}
+		if n == len(payload) {
+			copy(payload, pes)
+		} else {
+			d.packets[i] = repacket(packet, pes[:n])
+		}
+		pes = pes[n:]
+	}
+	last := slots[len(slots) - 1]
+	first := d.packets[slots[0]]
+	header := []byte{0x47, first[1] &^ 0x40, first[2], 0x10}
+	for len(pes) > 0 {
+		n := PacketSize - 4
+		if n > len(pes) {
+			n = len(pes)
+		}
+		d.packets[last] = append(d.packets[last], repacket(header, pes[:n])...)
+		pes = pes[n:]
+	}
+}
+
+// repacket builds a packet with the header and adaptation field of packet
+// and a payload that is stuffed to fill the packet. It returns nil if the
+// packet would be empty.
+func repacket(packet, payload []byte) []byte {
+	var adaptation []byte
+	if packet[3] & 0x20 != 0 {
+		adaptation = packet[5:5 + int(packet[4])]
+	}
+	if len(payload) == 0 && len(adaptation) == 0 {
+		return nil
+	}
+	space := PacketSize - 4 - len(payload)
+	result := make([]byte, PacketSize)
+	copy(result, packet[:4])
+	result[3] &^= 0x30
+	if len(payload) > 0 {
+		result[3] |= 0x10
+	}
+	if space > 0 {
+		result[3] |= 0x20
+		result[4] = byte(space - 1)
+		if space > 1 {
+			field := result[5:4 + space]
+			n := copy(field, adaptation)
+			if n == 0 {
+				// An adaptation field with stuffing needs its flags.
+				n = 1
+			}
+			for i := n; i < len(field); i++ {
+				field[i] = 0xff
+			}
+		}
+	}
+	copy(result[4 + space:], payload)
+	return result
+}
+
+// renumber fixes the continuity counters of the encrypted streams after
+// packets were added or removed.
+func (d *sampleAESDecrypter) renumber() {
+	counters := make(map[uint16]byte)
+	for _, packets := range d.packets {
+		for offset := 0; offset + PacketSize <= len(packets); offset += PacketSize {
+			packet := packets[offset:offset + PacketSize]
+			pid := uint16(packet[1] & 0x1f) << 8 | uint16(packet[2])
+			if _, ok := d.types[pid]; !ok || packet[3] & 0x10 == 0 {
+				continue
+			}
+			counter, ok := counters[pid]
+			if ok {
+				counter = (counter + 1) & 0x0f
+				packet[3] = packet[3] &^ 0x0f | counter
+			} else {
+				counter = packet[3] & 0x0f
+			}
+			counters[pid] = counter
+		}
+	}
+}
+
+// DecryptSampleAESAudio decrypts packed audio encrypted with SAMPLE-AES, that
+// is ADTS, AC-3 or E-AC-3 frames, optionally preceded by ID3 tags.
+func DecryptSampleAESAudio(data, key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid IV length")
+	}
+	d := &sampleAESDecrypter{block: block, iv: iv}
+	data = append([]byte(nil), data...)
+	start := 0
+	for start + 10 <= len(data) && string(data[start:start + 3]) == "ID3" {
+		header := data[start:]
+		size := int(header[6] & 0x7f) << 21 | int(header[7] & 0x7f) << 14 |
+			int(header[8] & 0x7f) << 7 | int(header[9] & 0x7f)
+		start += 10 + size
+		if header[5] & 0x10 != 0 {
+			start += 10
+		}
+	}
+	if start > len(data) {
+		return nil, errors.New("truncated ID3 tag")
+	}
+	if SyncFrameLength(data[start:]) > 0 {
+		d.decryptAC3(data[start:])
+	} else {
+		d.decryptADTS(data[start:])
+	}
+	return data, nil
+}
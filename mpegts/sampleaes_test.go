@@ -0,0 +1,213 @@
+package mpegts
+
+import (
+	"bytes"
+	"testing"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+)
+
+// The AES-128 CBC vectors of NIST SP 800-38A, F.2.1.
+var (
+	nistKey = fromHex("2b7e151628aed2a6abf7158809cf4f3c")
+	nistIV = fromHex("000102030405060708090a0b0c0d0e0f")
+	nistPlaintext = fromHex("6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e51")
+	nistCiphertext = fromHex("7649abac8119b246cee98e9b12e9197d5086cb9b507219ee95db113a917678b2")
+)
+
+func fromHex(s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func filled(n int, b byte) []byte {
+	return bytes.Repeat([]byte{b}, n)
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, part := range parts {
+		b = append(b, part...)
+	}
+	return b
+}
+
+// encryptNAL encrypts the RBSP of a slice NAL unit as SAMPLE-AES does and
+// inserts emulation prevention bytes afterwards.
+func encryptNAL(rbsp []byte) []byte {
+	rbsp = append([]byte(nil), rbsp...)
+	if len(rbsp) > 48 {
+		block, _ := aes.NewCipher(nistKey)
+		mode := cipher.NewCBCEncrypter(block, nistIV)
+		for i := 32; len(rbsp) - i > aes.BlockSize; i += 10 * aes.BlockSize {
+			mode.CryptBlocks(rbsp[i:i + aes.BlockSize], rbsp[i:i + aes.BlockSize])
+		}
+	}
+	return AddEmulationPrevention(rbsp)
+}
+
+// decryptedBlock returns the plaintext a block encrypts to ciphertext at the
+// start of a NAL unit.
+func decryptedBlock(ciphertext []byte) []byte {
+	block, _ := aes.NewCipher(nistKey)
+	plaintext := make([]byte, aes.BlockSize)
+	cipher.NewCBCDecrypter(block, nistIV).CryptBlocks(plaintext, ciphertext)
+	return plaintext
+}
+
+func annexB(nals ...[]byte) []byte {
+	var b []byte
+	for _, nal := range nals {
+		b = append(b, 0, 0, 0, 1)
+		b = append(b, nal...)
+	}
+	return b
+}
+
+func TestDecryptSampleAESVideo(t *testing.T) {
+	sps := concat([]byte{0x67}, filled(60, 0x11))
+	// The slice header byte is part of the clear leader of 32 bytes.
+	long := concat([]byte{0x65}, filled(31, 0x22), filled(10 * aes.BlockSize, 0x33), filled(40, 0x44))
+	// zerosSent is sent with zeros in its ciphertext, zerosClear has zeros in
+	// its plaintext.
+	zerosSent := concat([]byte{0x41, 0, 0, 0, 0, 0}, filled(26, 0x22), decryptedBlock(filled(16, 0)), filled(20, 0x44))
+	zerosClear := concat([]byte{0x65}, filled(31, 0x22), filled(16, 0), filled(20, 0x44))
+	tests := []struct {
+		name string
+		// clear and sent are the ES as it is decrypted and as it is sent.
+		clear []byte
+		sent []byte
+	} {
+		{"known ciphertext",
+			annexB(concat([]byte{0x65}, filled(31, 0x22), nistPlaintext[:16], []byte{0x55})),
+			annexB(concat([]byte{0x65}, filled(31, 0x22), nistCiphertext[:16], []byte{0x55}))},
+		{"one block of ten",
+			annexB(long), annexB(encryptNAL(long))},
+		{"48 bytes stay clear",
+			annexB(concat([]byte{0x41}, filled(47, 0x66))), annexB(concat([]byte{0x41}, filled(47, 0x66)))},
+		{"last block stays clear",
+			annexB(concat([]byte{0x41}, filled(31, 0x22), filled(16, 0x77))),
+			annexB(concat([]byte{0x41}, filled(31, 0x22), filled(16, 0x77)))},
+		{"parameter sets stay clear",
+			annexB(sps, long), annexB(sps, encryptNAL(long))},
+		// Emulation prevention bytes in the clear leader, in the
+		// ciphertext, and in the plaintext that replaces it.
+		{"emulation prevention",
+			annexB(AddEmulationPrevention(zerosSent), AddEmulationPrevention(zerosClear)),
+			annexB(encryptNAL(zerosSent), encryptNAL(zerosClear))},
+		{"several packets",
+			annexB(long, long, long, long), annexB(encryptNAL(long), encryptNAL(long), encryptNAL(long), encryptNAL(long))},
+	}
+	for _, test := range tests {
+		data := append(programTables(StreamTypeH264Encrypted), tsPackets(0x100, pes(90000, -1, 0, test.sent))...)
+		decrypted, err := DecryptSampleAES(data, nistKey, nistIV)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if len(decrypted) % PacketSize != 0 {
+			t.Errorf("%s: got %d bytes, not whole packets", test.name, len(decrypted))
+		}
+		streams, packets, err := Demux(decrypted)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if len(streams) != 1 || streams[0].Type != StreamTypeH264 {
+			t.Errorf("%s: got streams %v", test.name, streams)
+		}
+		if len(packets) != 1 || !bytes.Equal(packets[0].Data, test.clear) {
+			t.Errorf("%s: got\n% x\nwant\n% x", test.name, packets[0].Data, test.clear)
+		}
+		counter := -1
+		for offset := 0; offset < len(decrypted); offset += PacketSize {
+			packet := decrypted[offset:offset + PacketSize]
+			if pid, _, _ := parsePacket(packet); pid != 0x100 {
+				continue
+			}
+			if c := int(packet[3] & 0x0f); counter != -1 && c != (counter + 1) & 0x0f {
+				t.Errorf("%s: continuity counter %d follows %d", test.name, c, counter)
+			}
+			counter = int(packet[3] & 0x0f)
+		}
+	}
+}
+
+func TestDecryptSampleAESPMT(t *testing.T) {
+	data := programTables(StreamTypeH264Encrypted, StreamTypeAACEncrypted)
+	decrypted, err := DecryptSampleAES(data, nistKey, nistIV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streams, _, _ := Demux(decrypted)
+	if len(streams) != 2 || streams[0].Type != StreamTypeH264 || streams[1].Type != StreamTypeAAC {
+		t.Errorf("got streams %v", streams)
+	}
+	// The CRC of a section including its CRC is 0.
+	_, _, payload := parsePacket(decrypted[PacketSize:])
+	s := section(payload, true)
+	if crc := crc32MPEG(payload[1:1 + len(s) + 4]); crc != 0 {
+		t.Errorf("got PMT CRC remainder %#x", crc)
+	}
+}
+
+// encryptFrame encrypts the whole blocks of an audio frame after a clear
+// leader of 16 bytes.
+func encryptFrame(frame []byte) []byte {
+	frame = append([]byte(nil), frame...)
+	if len(frame) >= 32 {
+		block, _ := aes.NewCipher(nistKey)
+		encrypted := frame[16:16 + (len(frame) - 16) / aes.BlockSize * aes.BlockSize]
+		cipher.NewCBCEncrypter(block, nistIV).CryptBlocks(encrypted, encrypted)
+	}
+	return frame
+}
+
+func TestDecryptSampleAESAudio(t *testing.T) {
+	leader := filled(16, 0x10)
+	long := concat(leader, filled(5 * aes.BlockSize, 0x20), filled(7, 0x30))
+	id3 := concat([]byte("ID3"), []byte{4, 0, 0, 0, 0, 0, 3}, []byte{1, 2, 3})
+	tests := []struct {
+		name string
+		clear []byte
+		sent []byte
+	} {
+		{"known ciphertext",
+			adtsFrame(2, 4, 2, concat(leader, nistPlaintext, []byte{1, 2, 3, 4, 5})),
+			adtsFrame(2, 4, 2, concat(leader, nistCiphertext, []byte{1, 2, 3, 4, 5}))},
+		{"31 bytes stay clear",
+			adtsFrame(2, 4, 2, filled(31, 0x40)), adtsFrame(2, 4, 2, filled(31, 0x40))},
+		{"IV reset per frame",
+			concat(adtsFrame(2, 4, 2, long), adtsFrame(2, 4, 2, long)),
+			concat(adtsFrame(2, 4, 2, encryptFrame(long)), adtsFrame(2, 4, 2, encryptFrame(long)))},
+		{"ID3 tag",
+			concat(id3, adtsFrame(2, 4, 2, long)), concat(id3, adtsFrame(2, 4, 2, encryptFrame(long)))},
+	}
+	for _, test := range tests {
+		decrypted, err := DecryptSampleAESAudio(test.sent, nistKey, nistIV)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !bytes.Equal(decrypted, test.clear) {
+			t.Errorf("%s: got\n% x\nwant\n% x", test.name, decrypted, test.clear)
+		}
+	}
+
+	// Audio in transport streams is encrypted the same way.
+	frames := concat(adtsFrame(2, 4, 2, long), adtsFrame(2, 4, 2, filled(20, 0x40)))
+	sent := concat(adtsFrame(2, 4, 2, encryptFrame(long)), adtsFrame(2, 4, 2, filled(20, 0x40)))
+	data := append(programTables(StreamTypeAACEncrypted), tsPackets(0x100, pes(90000, -1, 0, sent))...)
+	decrypted, err := DecryptSampleAES(data, nistKey, nistIV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, packets, _ := Demux(decrypted)
+	if len(packets) != 1 || !bytes.Equal(packets[0].Data, frames) {
+		t.Errorf("transport stream: got %v", packets)
+	}
+}
@@ -0,0 +1,258 @@
+package request
+
+import (
+	"fmt"
+	"strings"
+	"strconv"
+)
+
+// Part is a partial segment of a Low-Latency HLS playlist. URI is replaced by
+// the name of the captured file like the URIs of segments, Index is -1 if it
+// was not captured.
+type Part struct {
+	URI string
+	// SeqId is the media sequence number of the segment the part belongs
+	// to, Number the position of the part in it.
+	SeqId uint64
+	Number int
+	Duration float64
+	Independent bool
+	Gap bool
+	Offset int64
+	Limit int64
+	Index int
+}
+
+// PreloadHint is a resource the server announced before it is available.
+type PreloadHint struct {
+	Type string
+	URI string
+	SeqId uint64
+	Number int
+	Offset int64
+	Limit int64
+}
+
+// ServerControl holds the attributes of EXT-X-SERVER-CONTROL.
+type ServerControl struct {
+	CanBlockReload bool
+	CanSkipUntil float64
+	CanSkipDateranges bool
+	HoldBack float64
+	PartHoldBack float64
+}
+
+// parseAttributes parses the attribute list of a tag. Quotes are removed from
+// quoted values.
+func parseAttributes(line string) map[string]string {
+	attributes := make(map[string]string)
+	if idx := strings.Index(line, ":"); idx != -1 {
+		line = line[idx + 1:]
+	} else {
+		return attributes
+	}
+	for line != "" {
+		idx := strings.Index(line, "=")
+		if idx == -1 {
+			break
+		}
+		name := strings.TrimSpace(line[:idx])
+		line = line[idx + 1:]
+		var value string
+		if strings.HasPrefix(line, "\"") {
+			end := strings.Index(line[1:], "\"")
+			if end == -1 {
+				end = len(line) - 1
+			}
+			value = line[1:end + 1]
+			line = line[end + 1:]
+			if strings.HasPrefix(line, "\"") {
+				line = line[1:]
+			}
+		} else {
+			end := strings.Index(line, ",")
+			if end == -1 {
+				end = len(line)
+			}
+			value = line[:end]
+			line = line[end:]
+		}
+		attributes[name] = value
+		line = strings.TrimPrefix(line, ",")
+	}
+	return attributes
+}
+
+// parseByteRange parses a BYTERANGE attribute of the form length[@offset].
+func parseByteRange(value string) (int64, int64) {
+	length, offset, _ := strings.Cut(value, "@")
+	limit, _ := strconv.ParseInt(length, 10, 64)
+	start, _ := strconv.ParseInt(offset, 10, 64)
+	return start, limit
+}
+
+// parseLowLatency fills the Low-Latency HLS fields of the playlist from the
+// captured text, which m3u8 does not know. Segments of delta updates are
+// renumbered as m3u8 does not count the skipped ones.
+func (p *Playlist) parseLowLatency() {
+	seqId := p.M3U8Playlist.SeqNo
+	number := 0
+	for _, line := range strings.Split(p.Original, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXT-X-PART-INF:"):
+			p.PartTarget, _ = strconv.ParseFloat(parseAttributes(line)["PART-TARGET"], 64)
+		case strings.HasPrefix(line, "#EXT-X-SERVER-CONTROL:"):
+			attributes := parseAttributes(line)
+			p.ServerControl.CanBlockReload = attributes["CAN-BLOCK-RELOAD"] == "YES"
+			p.ServerControl.CanSkipUntil, _ = strconv.ParseFloat(attributes["CAN-SKIP-UNTIL"], 64)
+			p.ServerControl.CanSkipDateranges = attributes["CAN-SKIP-DATERANGES"] == "YES"
+			p.ServerControl.HoldBack, _ = strconv.ParseFloat(attributes["HOLD-BACK"], 64)
+			p.ServerControl.PartHoldBack, _ = strconv.ParseFloat(attributes["PART-HOLD-BACK"], 64)
+		case strings.HasPrefix(line, "#EXT-X-SKIP:"):
+			skipped, _ := strconv.ParseUint(parseAttributes(line)["SKIPPED-SEGMENTS"], 10, 64)
+			p.Skipped += skipped
+			seqId += skipped
+		case strings.HasPrefix(line, "#EXT-X-PART:"):
+			attributes := parseAttributes(line)
+			part := Part {
+				URI: attributes["URI"],
+				SeqId: seqId,
+				Number: number,
+				Independent: attributes["INDEPENDENT"] == "YES",
+				Gap: attributes["GAP"] == "YES",
+				Index: -1,
+			}
+			part.Duration, _ = strconv.ParseFloat(attributes["DURATION"], 64)
+			if value, ok := attributes["BYTERANGE"]; ok {
+				part.Offset, part.Limit = parseByteRange(value)
+			}
+			p.Parts = append(p.Parts, part)
+			number++
+		case strings.HasPrefix(line, "#EXT-X-PRELOAD-HINT:"):
+			attributes := parseAttributes(line)
+			hint := PreloadHint {
+				Type: attributes["TYPE"],
+				URI: attributes["URI"],
+				SeqId: seqId,
+				Number: number,
+			}
+			hint.Offset, _ = strconv.ParseInt(attributes["BYTERANGE-START"], 10, 64)
+			hint.Limit, _ = strconv.ParseInt(attributes["BYTERANGE-LENGTH"], 10, 64)
+			p.PreloadHints = append(p.PreloadHints, hint)
+		case !strings.HasPrefix(line, "#"):
+			seqId++
+			number = 0
+		}
+	}
+	if p.Skipped > 0 {
+		p.M3U8Playlist.SeqNo += p.Skipped
+		p.M3U8SeqNo = p.M3U8Playlist.SeqNo
+		for _, segment := range p.M3U8Playlist.Segments {
+			if segment != nil {
+				segment.SeqId += p.Skipped
+			}
+		}
+	}
+}
+
+// IsLowLatency tells whether the playlist uses Low-Latency HLS.
+func (p *Playlist) IsLowLatency() bool {
+	return len(p.Parts) > 0 || len(p.PreloadHints) > 0 || p.PartTarget > 0
+}
+
+// Progress returns the media sequence number of the segment that is not
+// complete yet and the number of its parts that are.
+func (p *Playlist) Progress() (uint64, int) {
+	next := p.M3U8Playlist.SeqNo
+	for _, segment := range p.M3U8Playlist.Segments {
+		if segment != nil {
+			next = segment.SeqId + 1
+		}
+	}
+	parts := 0
+	for _, part := range p.Parts {
+		if part.SeqId == next {
+			parts++
+		}
+	}
+	return next, parts
+}
+
+// Newer tells whether the playlist has segments or parts that other does not.
+func (p *Playlist) Newer(other *Playlist) bool {
+	next, parts := p.Progress()
+	otherNext, otherParts := other.Progress()
+	return next > otherNext || next == otherNext && parts > otherParts
+}
+
+// Contains tells whether segment seqId is complete, or with part >= 0,
+// whether part of it is.
+func (p *Playlist) Contains(seqId uint64, part int) bool {
+	next, parts := p.Progress()
+	return seqId < next || seqId == next && part >= 0 && part < parts
+}
+
+// SkippableSegments returns the number of segments a delta update may skip,
+// those that end at least CAN-SKIP-UNTIL seconds before the playlist does.
+func (p *Playlist) SkippableSegments() int {
+	if p.ServerControl.CanSkipUntil <= 0 {
+		return 0
+	}
+	var durations []float64
+	for _, segment := range p.M3U8Playlist.Segments {
+		if segment != nil {
+			durations = append(durations, segment.Duration)
+		}
+	}
+	remaining := 0.0
+	next, _ := p.Progress()
+	for _, part := range p.Parts {
+		if part.SeqId == next {
+			remaining += part.Duration
+		}
+	}
+	skippable := 0
+	for i := len(durations) - 1; i >= 0; i-- {
+		if remaining >= p.ServerControl.CanSkipUntil {
+			skippable = i + 1
+			break
+		}
+		remaining += durations[i]
+	}
+	return skippable
+}
+
+// resolveParts replaces the URIs of the parts with the names of the captured
+// files. Parts that were not captured are left as they are.
+func (p *Playlist) resolveParts() {
+	for i := range p.Parts {
+		part := &p.Parts[i]
+		if part.URI == "" {
+			continue
+		}
+		filename, idx, err := p.FindOrSetURI(part.URI)
+		if err == nil {
+			part.URI = filename
+			part.Index = idx
+		}
+	}
+}
+
+// downloadParts is like resolveParts, but downloads the parts.
+func (p *Playlist) downloadParts(downloadFunc DownloadFunction, currURI string) error {
+	for i := range p.Parts {
+		part := &p.Parts[i]
+		if part.URI == "" || part.Gap {
+			continue
+		}
+		filename, err := p.FindOrDownloadURI(downloadFunc, currURI, part.URI)
+		if err != nil {
+			return fmt.Errorf("failed to download part %s: %s", part.URI, err)
+		}
+		part.URI = filename
+		part.Index = p.Files[filename]
+	}
+	return nil
+}
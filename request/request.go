@@ -8,8 +8,12 @@ import (
 	"strings"
 	"path"
 	"regexp"
+	"sort"
+	"sync"
+	"io"
 	"io/ioutil"
 	"encoding/json"
+	"encoding/base64"
 	"net/url"
 
 	"github.com/grafov/m3u8"
@@ -22,20 +26,63 @@ type Metadata struct {
 	Id string `json:"id"`
 	Status int `json:"status"`
 	Location string `json:"location"`
+	// Transfer metrics. All timestamps are in microseconds like Time, which
+	// is taken once the body has been read completely.
+	StartTime int64 `json:"start_time,omitempty"`
+	FirstByteTime int64 `json:"first_byte_time,omitempty"`
+	Size int64 `json:"size,omitempty"`
+	ContentLength int64 `json:"content_length,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// ContentEncoding is the encoding the body was sent with. The stored
+	// body is decoded unless Encoded is set, which means it could not be
+	// decoded and was stored as it was sent.
+	ContentEncoding string `json:"content_encoding,omitempty"`
+	Encoded bool `json:"encoded,omitempty"`
+	// Truncated is set if the body exceeded the size limit. Size is still
+	// the full size of the response, unless the client stopped reading and
+	// more than 16 MiB beyond the limit were left, then it is a lower bound.
+	Truncated bool `json:"truncated,omitempty"`
+	// Client is the address of the client that sent the request and User
+	// the name it authenticated as to the proxy.
+	Client string `json:"client,omitempty"`
+	User string `json:"user,omitempty"`
 }
 
 type RequestDatabase struct {
 	Requests []Metadata
 	FileDir string
+	byURI map[string][]int
+	// Locker guards Requests if set, for databases that grow while they
+	// are read.
+	Locker sync.Locker
 }
 
 type Playlist struct {
 	Database *RequestDatabase
 	Files map[string]int
+	// Names maps the absolute URIs of the files to their keys in Files.
+	Names map[string]string
+	Missing []string
+	// Inline holds the keys carried in data: URIs, by URI.
+	Inline map[string][]byte
+	// Unsupported lists the key URIs left as they are because their scheme
+	// or KEYFORMAT can not be handled, e.g. skd:// keys of a DRM system.
+	Unsupported []string
 	Index int
 	M3U8Playlist *m3u8.MediaPlaylist
+	// M3U8File is the playlist as serialized by m3u8, Original as it was
+	// captured.
 	M3U8File string
+	Original string
 	M3U8SeqNo uint64
+	// Low-Latency HLS tags, parsed from Original as m3u8 does not know them.
+	Parts []Part
+	PreloadHints []PreloadHint
+	PartTarget float64
+	ServerControl ServerControl
+	// Skipped is the number of segments a delta update replaced with
+	// EXT-X-SKIP.
+	Skipped uint64
 }
 
 func ReadMetadata(filename, fileDir string) (*RequestDatabase, error) {
@@ -56,26 +103,133 @@ func ReadMetadata(filename, fileDir string) (*RequestDatabase, error) {
 		}
 		data = append(data, d)
 	}
-	return &RequestDatabase {
+	database := &RequestDatabase {
 		Requests : data,
 		FileDir: fileDir,
+	}
+	database.buildIndex()
+	return database, nil
+}
+
+// MetadataFollower reads the requests that are appended to a metadata
+// journal while it is being recorded.
+type MetadataFollower struct {
+	File *os.File
+	Client string
+	Pending []byte
+}
+
+// FollowMetadata opens a metadata journal. Only requests of client are read
+// if it is set.
+func FollowMetadata(filename, client string) (*MetadataFollower, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &MetadataFollower {
+		File: file,
+		Client: client,
 	}, nil
 }
 
+// ReadNew adds the requests written since the last call to database and
+// returns their number. A partly written last line is kept for the next call.
+func (f *MetadataFollower) ReadNew(database *RequestDatabase) (int, error) {
+	data, err := io.ReadAll(f.File)
+	if err != nil {
+		return 0, err
+	}
+	f.Pending = append(f.Pending, data...)
+	added := 0
+	for {
+		end := bytes.IndexByte(f.Pending, '\n')
+		if end == -1 {
+			break
+		}
+		line := f.Pending[:end]
+		f.Pending = f.Pending[end + 1:]
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var metadata Metadata
+		err := json.Unmarshal(line, &metadata)
+		if err != nil {
+			return added, err
+		}
+		if f.Client != "" && metadata.Client != f.Client && metadata.User != f.Client {
+			continue
+		}
+		database.AddRequest(metadata)
+		added++
+	}
+	return added, nil
+}
+
+func (f *MetadataFollower) Close() error {
+	return f.File.Close()
+}
+
+func (r *RequestDatabase) buildIndex() {
+	r.byURI = make(map[string][]int)
+	for i := range r.Requests {
+		r.byURI[r.Requests[i].URI] = append(r.byURI[r.Requests[i].URI], i)
+	}
+}
+
 func NewRequestDatabase(fileDir string) *RequestDatabase {
 	return &RequestDatabase {
 		FileDir: fileDir,
+		byURI: make(map[string][]int),
+	}
+}
+
+// FilterClient returns a database with only the requests sent by the given
+// client address or proxy user.
+func (r *RequestDatabase) FilterClient(client string) *RequestDatabase {
+	filtered := &RequestDatabase {
+		FileDir: r.FileDir,
+	}
+	for _, metadata := range r.Requests {
+		if metadata.Client == client || metadata.User == client {
+			filtered.Requests = append(filtered.Requests, metadata)
+		}
+	}
+	filtered.buildIndex()
+	return filtered
+}
+
+func (r *RequestDatabase) lock() {
+	if r.Locker != nil {
+		r.Locker.Lock()
+	}
+}
+
+func (r *RequestDatabase) unlock() {
+	if r.Locker != nil {
+		r.Locker.Unlock()
 	}
 }
 
+// Request returns the metadata of request idx.
+func (r *RequestDatabase) Request(idx int) Metadata {
+	r.lock()
+	defer r.unlock()
+	return r.Requests[idx]
+}
+
 func (r *RequestDatabase) AddRequest(metadata Metadata) int {
+	r.lock()
+	defer r.unlock()
 	idx := len(r.Requests)
 	r.Requests = append(r.Requests, metadata)
+	r.byURI[metadata.URI] = append(r.byURI[metadata.URI], idx)
 	return idx
 }
 
 func (r *RequestDatabase) FindRequest(idx int, pattern string) int {
 	re := regexp.MustCompile(pattern)
+	r.lock()
+	defer r.unlock()
 	for i := idx; i < len(r.Requests); i++ {
 		if re.MatchString(r.Requests[i].URI) {
 			return i
@@ -85,6 +239,8 @@ func (r *RequestDatabase) FindRequest(idx int, pattern string) int {
 }
 
 func (r *RequestDatabase) FindRequestContains(idx int, pattern string) int {
+	r.lock()
+	defer r.unlock()
 	for i := idx; i < len(r.Requests); i++ {
 		if strings.Contains(r.Requests[i].URI, pattern) {
 			return i
@@ -93,8 +249,26 @@ func (r *RequestDatabase) FindRequestContains(idx int, pattern string) int {
 	return -1
 }
 
+// FindRequestNearest finds the first request of uri at or after idx, or the
+// last one before idx if there is none.
+func (r *RequestDatabase) FindRequestNearest(idx int, uri string) int {
+	r.lock()
+	defer r.unlock()
+	indices := r.byURI[uri]
+	if len(indices) == 0 {
+		return -1
+	}
+	i := sort.SearchInts(indices, idx)
+	if i < len(indices) {
+		return indices[i]
+	}
+	return indices[len(indices) - 1]
+}
+
 func (r *RequestDatabase) FindRequestReverse(idx int, pattern string) int {
 	re := regexp.MustCompile(pattern)
+	r.lock()
+	defer r.unlock()
 	if idx == -1 {
 		idx = len(r.Requests) - 1
 	}
@@ -107,6 +281,8 @@ func (r *RequestDatabase) FindRequestReverse(idx int, pattern string) int {
 }
 
 func (r *RequestDatabase) FindTimestamp(idx int, timestamp int64) int {
+	r.lock()
+	defer r.unlock()
 	for i := idx; i < len(r.Requests); i++ {
 		if r.Requests[i].Time > timestamp && i - 1 >= idx {
 			return i - 1
@@ -116,19 +292,32 @@ func (r *RequestDatabase) FindTimestamp(idx int, timestamp int64) int {
 }
 
 func (r *RequestDatabase) ReadBody(idx int) []byte {
-	filename := r.FileDir + "/" + r.Requests[idx].Id
+	filename := r.FileDir + "/" + r.Request(idx).Id
 	data, _ := ioutil.ReadFile(filename)
 	return data
 }
 
 func (r *RequestDatabase) HasFile(idx int) bool {
-	filename := r.FileDir + "/" + r.Requests[idx].Id
+	filename := r.FileDir + "/" + r.Request(idx).Id
 	_, err := os.Stat(filename)
 	return !os.IsNotExist(err)
 }
 
 func LoadPlaylist(requests *RequestDatabase, idx int,
 					reverse bool, timestamp int64) (*Playlist, int, error) {
+	return loadPlaylist(requests, idx, reverse, timestamp, false)
+}
+
+// LoadPartialPlaylist is like LoadPlaylist, but does not fail if files
+// referenced by the playlist were not captured. Their URIs are replaced by
+// absolute URIs, which are listed in Missing.
+func LoadPartialPlaylist(requests *RequestDatabase, idx int,
+					reverse bool, timestamp int64) (*Playlist, int, error) {
+	return loadPlaylist(requests, idx, reverse, timestamp, true)
+}
+
+func loadPlaylist(requests *RequestDatabase, idx int,
+					reverse bool, timestamp int64, partial bool) (*Playlist, int, error) {
 	if timestamp != -1 {
 		idx = requests.FindTimestamp(0, timestamp)
 	}
@@ -154,35 +343,63 @@ func LoadPlaylist(requests *RequestDatabase, idx int,
 	playlist := &Playlist {
 		Database: requests,
 		Files: make(map[string]int),
+		Names: make(map[string]string),
+		Inline: make(map[string][]byte),
 		Index: m3u8Idx,
 		M3U8Playlist: mediaPlaylist,
 		M3U8File: mediaPlaylist.String(),
+		Original: string(m3u8File),
 		M3U8SeqNo: mediaPlaylist.SeqNo,
 	}
-	if mediaPlaylist.Key != nil {
-		filename, _, err := playlist.FindOrSetURI(mediaPlaylist.Key.URI)
+	playlist.parseLowLatency()
+	resolve := func(uri string) (string, error) {
+		if uri == "" {
+			return uri, nil
+		}
+		filename, _, err := playlist.FindOrSetURI(uri)
+		if err != nil && partial {
+			// Names in Files have no slashes, so the absolute URI can't be
+			// mistaken for one of them.
+			uri = playlist.resolveURI(uri)
+			playlist.Missing = append(playlist.Missing, uri)
+			return uri, nil
+		}
+		return filename, err
+	}
+	if mediaPlaylist.Key != nil && !playlist.keepKeyURI(mediaPlaylist.Key) {
+		mediaPlaylist.Key.URI, err = resolve(mediaPlaylist.Key.URI)
+		if err != nil {
+			return nil, m3u8Idx, err
+		}
+	}
+	if mediaPlaylist.Map != nil {
+		mediaPlaylist.Map.URI, err = resolve(mediaPlaylist.Map.URI)
 		if err != nil {
 			return nil, m3u8Idx, err
 		}
-		mediaPlaylist.Key.URI = filename
 	}
 	for _, segment := range mediaPlaylist.Segments {
 		if segment == nil {
 			continue
 		}
-		filename, _, err := playlist.FindOrSetURI(segment.URI)
+		segment.URI, err = resolve(segment.URI)
 		if err != nil {
 			return nil, m3u8Idx, err
 		}
-		segment.URI = filename
-		if segment.Key != nil {
-			filename, _, err = playlist.FindOrSetURI(segment.Key.URI)
+		if segment.Key != nil && !playlist.keepKeyURI(segment.Key) {
+			segment.Key.URI, err = resolve(segment.Key.URI)
+			if err != nil {
+				return nil, m3u8Idx, err
+			}
+		}
+		if segment.Map != nil {
+			segment.Map.URI, err = resolve(segment.Map.URI)
 			if err != nil {
 				return nil, m3u8Idx, err
 			}
-			segment.Key.URI = filename
 		}
 	}
+	playlist.resolveParts()
 	return playlist, m3u8Idx, nil
 }
 
@@ -205,18 +422,29 @@ func LoadRemotePlaylist(requests *RequestDatabase, downloadFunc DownloadFunction
 	playlist := &Playlist {
 		Database: requests,
 		Files: make(map[string]int),
+		Names: make(map[string]string),
+		Inline: make(map[string][]byte),
 		Index: m3u8Idx,
 		M3U8Playlist: mediaPlaylist,
 		M3U8File: mediaPlaylist.String(),
+		Original: string(m3u8File),
 		M3U8SeqNo: mediaPlaylist.SeqNo,
 	}
-	if mediaPlaylist.Key != nil {
+	playlist.parseLowLatency()
+	if mediaPlaylist.Key != nil && !playlist.keepKeyURI(mediaPlaylist.Key) {
 		filename, err := playlist.FindOrDownloadURI(downloadFunc, uri, mediaPlaylist.Key.URI)
 		if err != nil {
 			return nil, err
 		}
 		mediaPlaylist.Key.URI = filename
 	}
+	if mediaPlaylist.Map != nil {
+		filename, err := playlist.FindOrDownloadURI(downloadFunc, uri, mediaPlaylist.Map.URI)
+		if err != nil {
+			return nil, err
+		}
+		mediaPlaylist.Map.URI = filename
+	}
 	for _, segment := range mediaPlaylist.Segments {
 		if segment == nil {
 			continue
@@ -226,68 +454,175 @@ func LoadRemotePlaylist(requests *RequestDatabase, downloadFunc DownloadFunction
 			return nil, err
 		}
 		segment.URI = filename
-		if segment.Key != nil {
+		if segment.Key != nil && !playlist.keepKeyURI(segment.Key) {
 			filename, err = playlist.FindOrDownloadURI(downloadFunc, uri, segment.Key.URI)
 			if err != nil {
 				return nil, err
 			}
 			segment.Key.URI = filename
 		}
+		if segment.Map != nil {
+			filename, err = playlist.FindOrDownloadURI(downloadFunc, uri, segment.Map.URI)
+			if err != nil {
+				return nil, err
+			}
+			segment.Map.URI = filename
+		}
+	}
+	err = playlist.downloadParts(downloadFunc, uri)
+	if err != nil {
+		return nil, err
 	}
 	return playlist, nil
 }
 
+// decodeDataURI returns the data of a data: URI.
+func decodeDataURI(uri string) ([]byte, error) {
+	header, data, ok := strings.Cut(strings.TrimPrefix(uri, "data:"), ",")
+	if !ok {
+		return nil, fmt.Errorf("invalid data URI")
+	}
+	if strings.HasSuffix(header, ";base64") {
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			decoded, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(data, "="))
+		}
+		return decoded, err
+	}
+	decoded, err := url.PathUnescape(data)
+	return []byte(decoded), err
+}
+
+// keepKeyURI tells whether the URI of key is left as it is instead of being
+// looked up. Keys in data: URIs are decoded into Inline, and keys that can
+// not be fetched or used are listed in Unsupported.
+func (p *Playlist) keepKeyURI(key *m3u8.Key) bool {
+	if key.URI == "" {
+		return false
+	}
+	if _, ok := p.Inline[key.URI]; ok {
+		return true
+	}
+	if p.IsUnsupported(key.URI) {
+		return true
+	}
+	if strings.HasPrefix(key.URI, "data:") {
+		data, err := decodeDataURI(key.URI)
+		if err == nil {
+			p.Inline[key.URI] = data
+			return true
+		}
+	} else if key.Keyformat == "" || key.Keyformat == "identity" {
+		parsedURI, err := url.Parse(key.URI)
+		if err != nil || parsedURI.Scheme == "" || parsedURI.Scheme == "http" ||
+				parsedURI.Scheme == "https" {
+			return false
+		}
+	}
+	p.Unsupported = append(p.Unsupported, key.URI)
+	return true
+}
+
+// IsUnsupported tells whether uri is the URI of a key listed in Unsupported.
+func (p *Playlist) IsUnsupported(uri string) bool {
+	for _, other := range p.Unsupported {
+		if other == uri {
+			return true
+		}
+	}
+	return false
+}
+
 func (p *Playlist) FindOrSetURI(uri string) (string, int, error) {
 	parsedURI, err := url.Parse(uri)
 	if err != nil {
 		return "", -1, err
 	}
-	var filename string
-	if parsedURI.Scheme == "" && parsedURI.Host == "" {
-		filename = path.Base(uri)
-	} else {
-		filename = path.Base(parsedURI.Path)
+	filename := path.Base(parsedURI.Path)
+	absoluteURI := p.resolveURI(uri)
+	if name, ok := p.Names[absoluteURI]; ok {
+		return name, p.Files[name], nil
 	}
-	idx, ok := p.Files[filename]
-	if ok {
-		return filename, idx, nil
+	// The request closest to the playlist is used, as some streams reuse
+	// URIs for different segments.
+	idx := p.Database.FindRequestNearest(p.Index, absoluteURI)
+	if idx == -1 {
+		idx = p.Database.FindRequestContains(0, filename)
 	}
-	idx = p.Database.FindRequestContains(0, filename)
 	if idx == -1 || !p.Database.HasFile(idx) {
 		return "", -1, fmt.Errorf("failed to find file")
 	}
+	if other, ok := p.Files[filename]; ok && other != idx {
+		// Different files with the same name, e.g. with different tokens.
+		filename = fmt.Sprintf("%d-%s", idx, filename)
+	}
 	p.Files[filename] = idx
+	p.Names[absoluteURI] = filename
 	return filename, idx, nil
 }
 
+// AbsoluteURI returns the absolute URI of name, which is either a key of
+// Files or the URI of a file that was not captured.
+func (p *Playlist) AbsoluteURI(name string) string {
+	for uri, filename := range p.Names {
+		if filename == name {
+			return uri
+		}
+	}
+	return p.resolveURI(name)
+}
+
+// resolveURI resolves uri against the URI of the playlist.
+func (p *Playlist) resolveURI(uri string) string {
+	parsedURI, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	parsedPlaylistURI, err := url.Parse(p.Database.Request(p.Index).URI)
+	if err != nil {
+		return uri
+	}
+	return parsedPlaylistURI.ResolveReference(parsedURI).String()
+}
+
 func (p *Playlist) FindOrDownloadURI(downloadaFunc DownloadFunction,
 										currURI, uri string) (string, error) {
 	parsedURI, err := url.Parse(uri)
 	if err != nil {
 		return "", err
 	}
-	var filename string
-	if parsedURI.Scheme == "" && parsedURI.Host == "" {
-		filename = path.Base(uri)
-	} else {
-		filename = path.Base(parsedURI.Path)
-	}
-	_, ok := p.Files[filename]
-	if ok {
-		return filename, nil
+	filename := path.Base(parsedURI.Path)
+	if name, ok := p.Names[uri]; ok {
+		return name, nil
 	}
 	_, idx, err := downloadaFunc(p.Database, currURI, uri, false)
 	if err != nil {
 		return "", err
 	}
+	if other, ok := p.Files[filename]; ok && other != idx {
+		filename = fmt.Sprintf("%d-%s", idx, filename)
+	}
 	p.Files[filename] = idx
+	p.Names[uri] = filename
 	return filename, nil
 }
 
 func (p *Playlist) ReadFile(filename string) []byte {
+	if data, ok := p.Inline[filename]; ok {
+		return data
+	}
 	idx, ok := p.Files[filename]
 	if !ok || idx == -1 {
 		return nil
 	}
 	return p.Database.ReadBody(idx)
 }
+
+// OpenFile opens the stored body of a file of the playlist.
+func (p *Playlist) OpenFile(filename string) (*os.File, error) {
+	idx, ok := p.Files[filename]
+	if !ok || idx == -1 {
+		return nil, fmt.Errorf("%s was not captured", filename)
+	}
+	return os.Open(p.Database.FileDir + "/" + p.Database.Request(idx).Id)
+}
@@ -0,0 +1,69 @@
+package request
+
+import (
+	"path"
+	"regexp"
+	"strings"
+	"net/url"
+)
+
+// LocalName returns the name the file referenced by uri is stored as in
+// Files. It returns false if the file was not captured.
+func (p *Playlist) LocalName(uri string) (string, bool) {
+	if name, ok := p.Names[uri]; ok {
+		return name, true
+	}
+	parsedURI, err := url.Parse(uri)
+	if err != nil {
+		return "", false
+	}
+	parsedPlaylistURI, err := url.Parse(p.Database.Request(p.Index).URI)
+	if err != nil {
+		return "", false
+	}
+	name, ok := p.Names[parsedPlaylistURI.ResolveReference(parsedURI).String()]
+	return name, ok
+}
+
+// Renamed tells whether a file is stored under another name than the last
+// element of its URI, because different files had the same name. Players
+// only request the right file if the URIs are rewritten then.
+func (p *Playlist) Renamed() bool {
+	for uri, name := range p.Names {
+		parsedURI, err := url.Parse(uri)
+		if err != nil || path.Base(parsedURI.Path) != name {
+			return true
+		}
+	}
+	return false
+}
+
+// URI attributes of tags, e.g. of EXT-X-KEY and EXT-X-MAP. The attribute name
+// must match exactly, so that e.g. X-ASSET-URI is left alone.
+var uriAttribute = regexp.MustCompile(`([:,]URI=")([^"]*)(")`)
+
+// RewriteURIs returns the playlist as it was captured with the URIs of the
+// captured files replaced by their names in Files. Every other byte, including
+// tags m3u8 does not know, is kept as it is.
+func (p *Playlist) RewriteURIs() string {
+	lines := strings.SplitAfter(p.Original, "\n")
+	for i, line := range lines {
+		text := strings.TrimRight(line, "\r\n")
+		ending := line[len(text):]
+		if strings.HasPrefix(text, "#EXT") {
+			text = uriAttribute.ReplaceAllStringFunc(text, func(match string) string {
+				parts := uriAttribute.FindStringSubmatch(match)
+				if name, ok := p.LocalName(parts[2]); ok {
+					return parts[1] + name + parts[3]
+				}
+				return match
+			})
+		} else if uri := strings.TrimSpace(text); uri != "" && !strings.HasPrefix(uri, "#") {
+			if name, ok := p.LocalName(uri); ok {
+				text = name
+			}
+		}
+		lines[i] = text + ending
+	}
+	return strings.Join(lines, "")
+}
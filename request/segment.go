@@ -0,0 +1,101 @@
+package request
+
+import (
+	"time"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+// Segment is a media segment of a playlist snapshot together with the tags
+// that apply to it. EXT-X-KEY and EXT-X-MAP stay in effect until the next
+// tag of the same kind, so they are carried forward from earlier segments.
+type Segment struct {
+	*m3u8.MediaSegment
+	DiscontinuitySeq uint64
+	Key *m3u8.Key
+	Map *m3u8.Map
+	Index int
+	// Start is the wall-clock time of the beginning of the segment. It is
+	// derived from EXT-X-PROGRAM-DATE-TIME if HasDateTime is set. Otherwise
+	// the last segment is assumed to end when the snapshot was captured.
+	Start time.Time
+	HasDateTime bool
+}
+
+// Rendition identifies the media playlist a snapshot was loaded from. The
+// query is left out as it usually carries changing tokens.
+func (p *Playlist) Rendition() string {
+	uri := p.Database.Request(p.Index).URI
+	if idx := strings.Index(uri, "?"); idx != -1 {
+		uri = uri[:idx]
+	}
+	return uri
+}
+
+// Time is the time the playlist snapshot was captured.
+func (p *Playlist) Time() int64 {
+	return p.Database.Request(p.Index).Time
+}
+
+// Segments returns the segments of the snapshot with the tags in effect for
+// each of them. Index is -1 for segments that were not captured.
+func (p *Playlist) Segments() []Segment {
+	var segments []Segment
+	mediaPlaylist := p.M3U8Playlist
+	discontinuitySeq := mediaPlaylist.DiscontinuitySeq
+	var key *m3u8.Key
+	var segmentMap *m3u8.Map
+	var dateTime time.Time
+	for _, segment := range mediaPlaylist.Segments {
+		if segment == nil {
+			continue
+		}
+		if segment.Discontinuity {
+			discontinuitySeq++
+		}
+		if segment.Key != nil {
+			key = segment.Key
+		}
+		if segment.Map != nil {
+			segmentMap = segment.Map
+		}
+		idx, ok := p.Files[segment.URI]
+		if !ok {
+			idx = -1
+		}
+		effectiveKey := key
+		if effectiveKey != nil && effectiveKey.Method == "NONE" {
+			effectiveKey = nil
+		}
+		if !segment.ProgramDateTime.IsZero() {
+			dateTime = segment.ProgramDateTime
+		}
+		segments = append(segments, Segment {
+			MediaSegment: segment,
+			DiscontinuitySeq: discontinuitySeq,
+			Key: effectiveKey,
+			Map: segmentMap,
+			Index: idx,
+			Start: dateTime,
+			HasDateTime: !dateTime.IsZero(),
+		})
+		if !dateTime.IsZero() {
+			dateTime = dateTime.Add(time.Duration(segment.Duration * float64(time.Second)))
+		}
+	}
+	end := time.UnixMicro(p.Time())
+	for i := len(segments) - 1; i >= 0; i-- {
+		duration := time.Duration(segments[i].Duration * float64(time.Second))
+		if !segments[i].HasDateTime {
+			segments[i].Start = end.Add(-duration)
+		}
+		end = end.Add(-duration)
+	}
+	return segments
+}
+
+// End is the wall-clock time of the end of the segment.
+func (s Segment) End() time.Time {
+	return s.Start.Add(time.Duration(s.Duration * float64(time.Second)))
+}